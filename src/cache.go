@@ -1,11 +1,18 @@
 package main
 
 import (
+	"cmp"
 	"encoding/binary"
 	"errors"
 	"io"
+	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"lrcd/models"
 	"lrcd/utils"
@@ -13,91 +20,483 @@ import (
 	"github.com/pierrec/lz4/v4"
 )
 
+const cacheVersion = 2
+
+// The modification time of cache files tracks their last access, which is
+// used for LRU eviction, while the fetch time is kept in the header
 type Cache struct {
-	path string
+	path       string
+	missTTL    time.Duration
+	ttl        time.Duration // Zero means never stale
+	maxEntries int           // Zero means unlimited
+	maxBytes   int64         // Zero means unlimited
+
+	mu    sync.Mutex
+	index map[string]string // Filename to cache key, loaded on first use
 }
 
+// The index maps file names back to tracks, as long names are hashed
+const indexFilename = "index"
+
 type CacheHeader struct {
+	Signature [4]byte
+	Version   uint16
+	Flags     uint16
+	BodySize  uint32 // Uncompressed
+	FetchedAt int64  // Unix milli
+}
+
+// Legacy header without version, written before the format was versioned
+type cacheHeaderV1 struct {
 	Signature [4]byte
 	BodySize  uint32
 	LineCount uint16
 	Source    [6]byte
 }
 
+const (
+	flagInstrumental = 1 << iota
+	flagUncompressed // Set if lz4 couldn't compress the body
+	flagUnsynced     // Plain lyrics, all lines at position 0
+)
+
+// The body is a sequence of sections, each prefixed by its kind and length.
+// Unknown sections are skipped so that new ones can be added without breaking
+// older readers.
+const (
+	sectionMeta      = 1
+	sectionLines     = 2
+	sectionWords     = 3
+	sectionTrack     = 4 // The track the entry was stored for
+	sectionSecondary = 5 // Translation and romanization of each line
+	sectionEnds      = 6 // End time of each line
+)
+
 var (
-	signature            = [4]byte{'l', 'r', 'c', 'd'}
+	signature            = [4]byte{'L', 'R', 'C', 'D'}
+	signatureV1          = [4]byte{'l', 'r', 'c', 'd'}
 	ErrSignatureMismatch = errors.New("signature mismatch")
+	ErrVersionMismatch   = errors.New("unsupported cache version")
+	ErrCorrupted         = errors.New("corrupted cache")
+	ErrExpired           = errors.New("cache expired")
 )
 
-func (c *Cache) Set(meta *models.MPRISMetadata, lyrics *models.Lyrics) error {
-	bodySize := 0
+type cacheWriter struct {
+	buf []byte
+}
+
+func (w *cacheWriter) uvarint(v uint64) {
+	w.buf = binary.AppendUvarint(w.buf, v)
+}
+
+func (w *cacheWriter) varint(v int64) {
+	w.buf = binary.AppendVarint(w.buf, v)
+}
+
+func (w *cacheWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *cacheWriter) section(kind byte, fn func(w *cacheWriter)) {
+	sw := &cacheWriter{}
+	fn(sw)
+	w.buf = append(w.buf, kind)
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, uint32(len(sw.buf)))
+	w.buf = append(w.buf, sw.buf...)
+}
+
+type cacheReader struct {
+	buf []byte
+	err error
+}
+
+func (r *cacheReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = ErrCorrupted
+		r.buf = nil
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *cacheReader) varint() int64 {
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = ErrCorrupted
+		r.buf = nil
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *cacheReader) string() string {
+	n := r.uvarint()
+	if n > uint64(len(r.buf)) {
+		r.err = ErrCorrupted
+		r.buf = nil
+		return ""
+	}
+	s := string(r.buf[:n])
+	r.buf = r.buf[n:]
+	return s
+}
+
+func (r *cacheReader) section() (byte, *cacheReader) {
+	if len(r.buf) < 5 {
+		r.err = ErrCorrupted
+		r.buf = nil
+		return 0, nil
+	}
+	kind := r.buf[0]
+	n := binary.LittleEndian.Uint32(r.buf[1:])
+	if uint64(n) > uint64(len(r.buf)-5) {
+		r.err = ErrCorrupted
+		r.buf = nil
+		return 0, nil
+	}
+	sr := &cacheReader{buf: r.buf[5 : 5+n]}
+	r.buf = r.buf[5+n:]
+	return kind, sr
+}
+
+func encodeBody(meta *models.MPRISMetadata, lyrics *models.Lyrics) []byte {
+	w := &cacheWriter{}
+	w.section(sectionTrack, func(w *cacheWriter) {
+		w.string(meta.Title)
+		w.uvarint(uint64(len(meta.Artists)))
+		for _, a := range meta.Artists {
+			w.string(a)
+		}
+		w.string(meta.Album)
+		w.uvarint(uint64(meta.Duration.Milliseconds()))
+	})
+	w.section(sectionMeta, func(w *cacheWriter) {
+		w.string(lyrics.Source)
+		match := lyrics.Match
+		if match == nil {
+			match = &models.MatchInfo{}
+		}
+		w.string(match.Title)
+		w.uvarint(uint64(len(match.Artists)))
+		for _, a := range match.Artists {
+			w.string(a)
+		}
+		w.uvarint(uint64(match.Duration.Milliseconds()))
+		w.string(match.ID)
+	})
+	w.section(sectionLines, func(w *cacheWriter) {
+		w.uvarint(uint64(lyrics.Len()))
+		for _, line := range lyrics.Lines {
+			w.varint(int64(line.Position))
+			w.string(line.Text)
+		}
+	})
+	hasWords := false
 	for _, line := range lyrics.Lines {
-		bodySize += len(line.Text) + 6
+		if len(line.Words) > 0 {
+			hasWords = true
+			break
+		}
+	}
+	if hasWords {
+		w.section(sectionWords, func(w *cacheWriter) {
+			for _, line := range lyrics.Lines {
+				w.uvarint(uint64(len(line.Words)))
+				for _, word := range line.Words {
+					w.varint(int64(word.Position))
+					w.string(word.Text)
+				}
+			}
+		})
+	}
+	if slices.ContainsFunc(lyrics.Lines, func(line *models.LyricLine) bool {
+		return line.Translation != "" || line.Romanization != ""
+	}) {
+		w.section(sectionSecondary, func(w *cacheWriter) {
+			for _, line := range lyrics.Lines {
+				w.string(line.Translation)
+				w.string(line.Romanization)
+			}
+		})
+	}
+	if slices.ContainsFunc(lyrics.Lines, func(line *models.LyricLine) bool { return line.End != 0 }) {
+		w.section(sectionEnds, func(w *cacheWriter) {
+			for _, line := range lyrics.Lines {
+				w.varint(int64(line.End))
+			}
+		})
+	}
+	return w.buf
+}
+
+// The track is left untouched if the entry predates the track section
+func decodeBody(body []byte, lyrics *models.Lyrics, track *models.MPRISMetadata) error {
+	r := &cacheReader{buf: body}
+	for len(r.buf) > 0 && r.err == nil {
+		kind, sr := r.section()
+		if sr == nil {
+			break
+		}
+		switch kind {
+		case sectionTrack:
+			track.Title = sr.string()
+			n := sr.uvarint()
+			for range min(n, uint64(len(sr.buf))) {
+				track.Artists = append(track.Artists, sr.string())
+			}
+			track.Album = sr.string()
+			track.Duration = time.Duration(sr.uvarint()) * time.Millisecond
+		case sectionMeta:
+			lyrics.Source = sr.string()
+			match := &models.MatchInfo{Title: sr.string()}
+			n := sr.uvarint()
+			for range min(n, uint64(len(sr.buf))) {
+				match.Artists = append(match.Artists, sr.string())
+			}
+			match.Duration = time.Duration(sr.uvarint()) * time.Millisecond
+			// Appended later, absent from older entries
+			if len(sr.buf) > 0 {
+				match.ID = sr.string()
+			}
+			if match.Title != "" || len(match.Artists) > 0 {
+				lyrics.Match = match
+			}
+		case sectionLines:
+			n := sr.uvarint()
+			lyrics.Lines = make([]*models.LyricLine, 0, min(n, uint64(len(sr.buf))))
+			for range n {
+				if sr.err != nil {
+					break
+				}
+				lyrics.Lines = append(lyrics.Lines, &models.LyricLine{
+					Position: int(sr.varint()),
+					Text:     sr.string(),
+				})
+			}
+		case sectionSecondary:
+			for _, line := range lyrics.Lines {
+				line.Translation = sr.string()
+				line.Romanization = sr.string()
+				if sr.err != nil {
+					break
+				}
+			}
+		case sectionEnds:
+			for _, line := range lyrics.Lines {
+				line.End = int(sr.varint())
+				if sr.err != nil {
+					break
+				}
+			}
+		case sectionWords:
+			for _, line := range lyrics.Lines {
+				n := sr.uvarint()
+				for range n {
+					if sr.err != nil {
+						break
+					}
+					line.Words = append(line.Words, &models.LyricWord{
+						Position: int(sr.varint()),
+						Text:     sr.string(),
+					})
+				}
+			}
+		}
+		if sr.err != nil {
+			return sr.err
+		}
+	}
+	return r.err
+}
+
+func (c *Cache) Set(meta *models.MPRISMetadata, lyrics *models.Lyrics) error {
+	body := encodeBody(meta, lyrics)
+	fetchedAt := lyrics.FetchedAt
+	if fetchedAt.IsZero() {
+		fetchedAt = time.Now()
 	}
 	h := CacheHeader{
 		Signature: signature,
-		LineCount: uint16(lyrics.Len()),
-		BodySize:  uint32(bodySize),
+		Version:   cacheVersion,
+		BodySize:  uint32(len(body)),
+		FetchedAt: fetchedAt.UnixMilli(),
+	}
+	if lyrics.Instrumental {
+		h.Flags |= flagInstrumental
+	}
+	if lyrics.Unsynced {
+		h.Flags |= flagUnsynced
 	}
-	copy(h.Source[:], []byte(lyrics.Source))
 	header := make([]byte, binary.Size(h))
 	binary.Encode(header, binary.LittleEndian, h)
-	body := make([]byte, bodySize)
-	offset := 0
-	for _, line := range lyrics.Lines {
-		textLen := len(line.Text)
-		binary.LittleEndian.PutUint32(body[offset:], uint32(line.Position))
-		offset += 4
-		binary.LittleEndian.PutUint16(body[offset:], uint16(textLen))
-		offset += 2
-		copy(body[offset:], []byte(line.Text))
-		offset += textLen
-	}
-	compressed := make([]byte, lz4.CompressBlockBound(bodySize))
+	compressed := make([]byte, lz4.CompressBlockBound(len(body)))
 	compressor := lz4.CompressorHC{Level: lz4.Level9}
 	n, err := compressor.CompressBlock(body, compressed)
 	if err != nil {
 		return err
 	}
-	fpath := filepath.Join(c.path, utils.FormatFilename(meta))
+	if n == 0 && len(body) > 0 {
+		compressed = body
+		n = len(body)
+		h.Flags |= flagUncompressed
+		binary.Encode(header, binary.LittleEndian, h)
+	}
+	name := utils.FormatFilename(meta)
+	fpath := filepath.Join(c.path, name)
 	tmp := fpath + ".tmp"
 	err = os.WriteFile(tmp, append(header, compressed[:n]...), 0o644)
 	if err != nil {
 		return err
 	}
-	return os.Rename(tmp, fpath)
+	err = os.Rename(tmp, fpath)
+	if err != nil {
+		return err
+	}
+	err = c.updateIndex(name, utils.CacheKey(meta))
+	if err != nil {
+		return err
+	}
+	return c.Evict()
 }
 
+// Entries written before cache keys included the album and duration
+func legacyFilename(meta *models.MPRISMetadata) string {
+	return strings.ReplaceAll(utils.FormatTrack(meta), "/", "_") + ".cache"
+}
+
+// Lyrics without lines are negative entries, where an empty source means no
+// provider matched and a non-empty one means the source reported an instrumental
 func (c *Cache) Get(meta *models.MPRISMetadata) (*models.Lyrics, error) {
-	f, err := os.Open(filepath.Join(c.path, utils.FormatFilename(meta)))
+	fpath := filepath.Join(c.path, utils.FormatFilename(meta))
+	lyrics, migrate, err := c.readFile(fpath, &models.MPRISMetadata{})
+	if errors.Is(err, os.ErrNotExist) {
+		legacy := legacyFilename(meta)
+		lyrics, _, err = c.readFile(filepath.Join(c.path, legacy), &models.MPRISMetadata{})
+		if err == nil {
+			slog.Debug("cache key migrated", "track", utils.CacheKey(meta))
+			err = c.Set(meta, lyrics)
+			if err == nil {
+				os.Remove(filepath.Join(c.path, legacy))
+				c.updateIndex(legacy, "")
+			}
+		}
+	} else if err == nil && migrate {
+		err = c.Set(meta, lyrics)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if lyrics.Len() == 0 && time.Since(lyrics.FetchedAt) > c.missTTL {
+		return nil, ErrExpired
+	}
+	now := time.Now()
+	os.Chtimes(fpath, now, now)
+	return lyrics, nil
+}
+
+// The returned bool reports whether the file is in a legacy format and
+// should be migrated, track is filled if the entry records it
+func (c *Cache) readFile(path string, track *models.MPRISMetadata) (*models.Lyrics, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
 	defer f.Close()
+	var sig [4]byte
+	_, err = io.ReadFull(f, sig[:])
+	if err != nil {
+		return nil, false, err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, false, err
+	}
+	switch sig {
+	case signature:
+		lyrics, err := c.read(f, track)
+		return lyrics, false, err
+	case signatureV1:
+		lyrics, err := c.readV1(f)
+		if err != nil {
+			return nil, false, err
+		}
+		// Keep the original fetch time
+		stat, err := f.Stat()
+		if err == nil {
+			lyrics.FetchedAt = stat.ModTime()
+		}
+		return lyrics, true, nil
+	}
+	return nil, false, ErrSignatureMismatch
+}
+
+func (c *Cache) read(f *os.File, track *models.MPRISMetadata) (*models.Lyrics, error) {
 	header := CacheHeader{}
-	err = binary.Read(f, binary.LittleEndian, &header)
+	err := binary.Read(f, binary.LittleEndian, &header)
 	if err != nil {
 		return nil, err
 	}
-	if header.Signature != signature {
-		return nil, ErrSignatureMismatch
+	if header.Version != cacheVersion {
+		return nil, ErrVersionMismatch
 	}
 	buf, err := io.ReadAll(f)
 	if err != nil {
 		return nil, err
 	}
-	deflated := make([]byte, header.BodySize)
-	_, err = lz4.UncompressBlock(buf, deflated)
+	body := buf
+	if header.Flags&flagUncompressed == 0 {
+		body = make([]byte, header.BodySize)
+		_, err = lz4.UncompressBlock(buf, body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	lyrics := &models.Lyrics{
+		Instrumental: header.Flags&flagInstrumental != 0,
+		Unsynced:     header.Flags&flagUnsynced != 0,
+		FetchedAt:    time.UnixMilli(header.FetchedAt),
+	}
+	err = decodeBody(body, lyrics, track)
+	if err != nil {
+		return nil, err
+	}
+	return lyrics, nil
+}
+
+func (c *Cache) readV1(f *os.File) (*models.Lyrics, error) {
+	header := cacheHeaderV1{}
+	err := binary.Read(f, binary.LittleEndian, &header)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := io.ReadAll(f)
 	if err != nil {
 		return nil, err
 	}
+	deflated := make([]byte, header.BodySize)
+	if header.BodySize > 0 {
+		_, err = lz4.UncompressBlock(buf, deflated)
+		if err != nil {
+			return nil, err
+		}
+	}
 	lines := make([]*models.LyricLine, header.LineCount)
 	offset := 0
 	for i := range int(header.LineCount) {
+		if offset+6 > len(deflated) {
+			return nil, ErrCorrupted
+		}
 		position := int(binary.LittleEndian.Uint32(deflated[offset:]))
 		offset += 4
 		textLen := int(binary.LittleEndian.Uint16(deflated[offset:]))
 		offset += 2
+		if offset+textLen > len(deflated) {
+			return nil, ErrCorrupted
+		}
 		lines[i] = &models.LyricLine{
 			Position: position,
 			Text:     string(deflated[offset : offset+textLen]),
@@ -109,8 +508,195 @@ func (c *Cache) Get(meta *models.MPRISMetadata) (*models.Lyrics, error) {
 			break
 		}
 	}
+	source := string(header.Source[:offset+1])
 	return &models.Lyrics{
-		Lines:  lines,
-		Source: string(header.Source[:offset+1]),
+		Lines:        lines,
+		Source:       source,
+		Instrumental: len(lines) == 0 && source != "",
 	}, nil
 }
+
+// Stale lyrics are still served, but should be refreshed in the background
+func (c *Cache) Stale(lyrics *models.Lyrics) bool {
+	return c.ttl > 0 && lyrics.Len() > 0 && time.Since(lyrics.FetchedAt) > c.ttl
+}
+
+// Evict removes the least recently used entries until the limits are met
+func (c *Cache) Evict() error {
+	if c.maxEntries <= 0 && c.maxBytes <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries, err := c.entries()
+	if err != nil {
+		return err
+	}
+	total := int64(0)
+	for _, e := range entries {
+		total += e.Size
+	}
+	slices.SortFunc(entries, func(a, b *CacheEntry) int { return a.AccessedAt.Compare(b.AccessedAt) })
+	count := len(entries)
+	evicted := false
+	for _, e := range entries {
+		if (c.maxEntries <= 0 || count <= c.maxEntries) && (c.maxBytes <= 0 || total <= c.maxBytes) {
+			break
+		}
+		err = os.Remove(filepath.Join(c.path, e.Name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		slog.Debug("cache evicted", "track", e.Key)
+		count--
+		total -= e.Size
+		delete(c.index, e.Name)
+		evicted = true
+	}
+	if !evicted {
+		return nil
+	}
+	return c.saveIndex()
+}
+
+func (c *Cache) Delete(meta *models.MPRISMetadata) error {
+	os.Remove(filepath.Join(c.path, legacyFilename(meta)))
+	return c.Remove(utils.FormatFilename(meta))
+}
+
+type CacheEntry struct {
+	Name       string // File name
+	Key        string // Track, see utils.CacheKey
+	Size       int64
+	AccessedAt time.Time
+}
+
+// Entries lists all cache files, sorted by track
+func (c *Cache) Entries() ([]*CacheEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries, err := c.entries()
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(entries, func(a, b *CacheEntry) int { return cmp.Compare(a.Key, b.Key) })
+	return entries, nil
+}
+
+// Must be called with c.mu held
+func (c *Cache) entries() ([]*CacheEntry, error) {
+	err := c.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	dirEntries, err := os.ReadDir(c.path)
+	if err != nil {
+		return nil, err
+	}
+	entries := []*CacheEntry{}
+	for _, e := range dirEntries {
+		if !e.Type().IsRegular() || filepath.Ext(e.Name()) != ".cache" {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		key, ok := c.index[e.Name()]
+		if !ok {
+			key = strings.TrimSuffix(e.Name(), ".cache")
+		}
+		entries = append(entries, &CacheEntry{
+			Name:       e.Name(),
+			Key:        key,
+			Size:       info.Size(),
+			AccessedAt: info.ModTime(),
+		})
+	}
+	return entries, nil
+}
+
+// ReadEntry reads a cache file regardless of its age, the track is empty if
+// the entry predates the track section
+func (c *Cache) ReadEntry(name string) (*models.Lyrics, *models.MPRISMetadata, error) {
+	track := &models.MPRISMetadata{}
+	lyrics, _, err := c.readFile(filepath.Join(c.path, name), track)
+	if err != nil {
+		return nil, nil, err
+	}
+	return lyrics, track, nil
+}
+
+// Remove deletes a cache file by its name
+func (c *Cache) Remove(name string) error {
+	err := os.Remove(filepath.Join(c.path, name))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return c.updateIndex(name, "")
+}
+
+// Must be called with c.mu held
+func (c *Cache) loadIndex() error {
+	if c.index != nil {
+		return nil
+	}
+	c.index = map[string]string{}
+	buf, err := os.ReadFile(filepath.Join(c.path, indexFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for line := range strings.Lines(string(buf)) {
+		name, key, ok := strings.Cut(strings.TrimSuffix(line, "\n"), "\t")
+		if ok {
+			c.index[name] = key
+		}
+	}
+	return nil
+}
+
+// Must be called with c.mu held, entries are sorted by key to be readable
+func (c *Cache) saveIndex() error {
+	names := slices.Collect(maps.Keys(c.index))
+	slices.SortFunc(names, func(a, b string) int {
+		return cmp.Or(cmp.Compare(c.index[a], c.index[b]), cmp.Compare(a, b))
+	})
+	builder := &strings.Builder{}
+	for _, name := range names {
+		builder.WriteString(name)
+		builder.WriteByte('\t')
+		builder.WriteString(c.index[name])
+		builder.WriteByte('\n')
+	}
+	fpath := filepath.Join(c.path, indexFilename)
+	err := os.WriteFile(fpath+".tmp", []byte(builder.String()), 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(fpath+".tmp", fpath)
+}
+
+var indexEscaper = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+// An empty key removes the entry
+func (c *Cache) updateIndex(name string, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.loadIndex()
+	if err != nil {
+		return err
+	}
+	key = indexEscaper.Replace(key)
+	old, ok := c.index[name]
+	if key == "" && !ok || key != "" && old == key {
+		return nil
+	}
+	if key == "" {
+		delete(c.index, name)
+	} else {
+		c.index[name] = key
+	}
+	return c.saveIndex()
+}
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"lrcd/models"
+	"lrcd/utils"
+
+	"github.com/pierrec/lz4/v4"
 )
 
 func TestCacheGet(t *testing.T) {
@@ -24,3 +32,186 @@ func TestCacheGet(t *testing.T) {
 		t.Logf("[%02d:%02d.%03d] %s\n", line.Position/60_000, line.Position/1000%60, line.Position%1000, line.Text)
 	}
 }
+
+func TestCacheMiss(t *testing.T) {
+	cache := &Cache{path: t.TempDir(), missTTL: time.Hour}
+	meta := &models.MPRISMetadata{
+		Title:   "Instrumental",
+		Artists: []string{"Artist"},
+	}
+	err := cache.Set(meta, &models.Lyrics{Source: "lrclib", Instrumental: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lyrics, err := cache.Get(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lyrics.Len() != 0 || !lyrics.Instrumental {
+		t.Errorf("unexpected lyrics %+v", lyrics)
+	}
+
+	cache.missTTL = 0
+	_, err = cache.Get(meta)
+	if !errors.Is(err, ErrExpired) {
+		t.Errorf("expected expired entry, got %v", err)
+	}
+}
+
+func TestCacheRoundTrip(t *testing.T) {
+	cache := &Cache{path: t.TempDir()}
+	meta := &models.MPRISMetadata{
+		Title:   "春日影",
+		Artists: []string{"CRYCHIC"},
+	}
+	long := strings.Repeat("長", 30000) // Overflows the uint16 text length of v1
+	lyrics := &models.Lyrics{
+		Lines: []*models.LyricLine{
+			{Position: 1000, Text: "Hello world", Words: []*models.LyricWord{{Position: 1000, Text: "Hello "}, {Position: 1500, Text: "world"}}},
+			{Position: 2000, End: 4000, Text: long, Translation: "translation", Romanization: "romanization"},
+		},
+		Source: "custom-provider",
+		Match:  &models.MatchInfo{Title: "春日影", Artists: []string{"CRYCHIC"}, Duration: 258 * time.Second},
+	}
+	err := cache.Set(meta, lyrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := cache.Get(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Source != lyrics.Source || got.Len() != 2 || got.Lines[1].Text != long || got.FetchedAt.IsZero() {
+		t.Errorf("unexpected lyrics %+v", got)
+	}
+	if len(got.Lines[0].Words) != 2 || got.Lines[0].Words[1].Position != 1500 {
+		t.Errorf("unexpected words %+v", got.Lines[0].Words)
+	}
+	if got.Lines[0].Translation != "" || got.Lines[1].Translation != "translation" || got.Lines[1].Romanization != "romanization" {
+		t.Errorf("unexpected secondary tracks %+v", got.Lines)
+	}
+	if got.Lines[0].End != 0 || got.Lines[1].End != 4000 {
+		t.Errorf("unexpected end times %+v", got.Lines)
+	}
+	if got.Match == nil || got.Match.Title != "春日影" || got.Match.Duration != 258*time.Second {
+		t.Errorf("unexpected match %+v", got.Match)
+	}
+}
+
+func TestCacheMigrateV1(t *testing.T) {
+	cache := &Cache{path: t.TempDir()}
+	meta := &models.MPRISMetadata{
+		Title:   "Title",
+		Artists: []string{"Artist"},
+	}
+	body := binary.LittleEndian.AppendUint32(nil, 1000)
+	body = binary.LittleEndian.AppendUint16(body, 5)
+	body = append(body, "Hello"...)
+	compressed := make([]byte, lz4.CompressBlockBound(len(body)))
+	n, err := (&lz4.CompressorHC{Level: lz4.Level9}).CompressBlock(body, compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Skip("body is incompressible")
+	}
+	h := cacheHeaderV1{Signature: signatureV1, BodySize: uint32(len(body)), LineCount: 1}
+	copy(h.Source[:], "ncm")
+	header := make([]byte, binary.Size(h))
+	binary.Encode(header, binary.LittleEndian, h)
+	err = os.WriteFile(filepath.Join(cache.path, utils.FormatFilename(meta)), append(header, compressed[:n]...), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 { // Second read hits the migrated entry
+		lyrics, err := cache.Get(meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lyrics.Source != "ncm" || lyrics.Len() != 1 || lyrics.Lines[0].Text != "Hello" {
+			t.Errorf("unexpected lyrics %+v", lyrics)
+		}
+	}
+	buf, _ := os.ReadFile(filepath.Join(cache.path, utils.FormatFilename(meta)))
+	if !bytes.HasPrefix(buf, signature[:]) {
+		t.Error("entry not migrated")
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	cache := &Cache{path: t.TempDir(), ttl: time.Hour}
+	lyrics := &models.Lyrics{Lines: []*models.LyricLine{{Position: 0, Text: "line"}}, Source: "lrclib"}
+	metas := []*models.MPRISMetadata{
+		{Title: "A", Artists: []string{"Artist"}},
+		{Title: "B", Artists: []string{"Artist"}},
+		{Title: "C", Artists: []string{"Artist"}},
+	}
+	for i, meta := range metas[:2] {
+		err := cache.Set(meta, lyrics)
+		if err != nil {
+			t.Fatal(err)
+		}
+		atime := time.Now().Add(-time.Duration(2-i) * time.Hour)
+		os.Chtimes(filepath.Join(cache.path, utils.FormatFilename(meta)), atime, atime)
+	}
+	// Reading A makes B the least recently used entry
+	_, err := cache.Get(metas[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.maxEntries = 2
+	err = cache.Set(metas[2], lyrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, meta := range metas {
+		_, err := cache.Get(meta)
+		if evicted := errors.Is(err, os.ErrNotExist); evicted != (i == 1) {
+			t.Errorf("entry %s: unexpected error %v", meta.Title, err)
+		}
+	}
+
+	fresh, err := cache.Get(metas[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := *fresh
+	stale.FetchedAt = time.Now().Add(-2 * time.Hour)
+	if !cache.Stale(&stale) || cache.Stale(fresh) {
+		t.Error("unexpected staleness")
+	}
+}
+
+func TestCacheLegacyKey(t *testing.T) {
+	cache := &Cache{path: t.TempDir()}
+	meta := &models.MPRISMetadata{
+		Title:    "春日影",
+		Artists:  []string{"CRYCHIC"},
+		Album:    "春日影",
+		Duration: 4 * time.Minute,
+	}
+	lyrics := &models.Lyrics{Lines: []*models.LyricLine{{Position: 0, Text: "line"}}, Source: "lrclib"}
+	// Written under the key without album and duration
+	err := cache.Set(&models.MPRISMetadata{Title: meta.Title, Artists: meta.Artists}, lyrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := cache.Get(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Len() != 1 {
+		t.Errorf("unexpected lyrics %+v", got)
+	}
+	_, err = os.Stat(filepath.Join(cache.path, legacyFilename(meta)))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Error("legacy entry not removed")
+	}
+	index, err := os.ReadFile(filepath.Join(cache.path, indexFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(index) != utils.FormatFilename(meta)+"\t"+utils.CacheKey(meta)+"\n" {
+		t.Errorf("entry missing from index:\n%s", index)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"lrcd/models"
+	"lrcd/utils"
+)
+
+// Archived .lrc files larger than this are skipped on import
+const maxImportSize = 1 << 20
+
+const cacheUsage = `usage: lrcd cache <command> [arguments]
+
+commands:
+  list [pattern]          list cached tracks
+  show <pattern>          print a cached entry as LRC
+  delete <pattern>...     delete matching entries
+  purge [-misses]         delete all entries, or only tracks without lyrics
+  export <file.tar.gz>    export cached lyrics as an archive of .lrc files
+  import <file.tar.gz>    import an archive of .lrc files
+
+Patterns are case insensitive, and match as a substring of the track unless
+they contain glob characters.`
+
+func runCacheCommand(dir string, args []string) error {
+	if len(args) == 0 {
+		return errors.New(cacheUsage)
+	}
+	cache := &Cache{path: dir}
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "list", "ls":
+		pattern := ""
+		if len(args) > 0 {
+			pattern = args[0]
+		}
+		return listCache(cache, pattern)
+	case "show":
+		if len(args) != 1 {
+			return errors.New("usage: lrcd cache show <pattern>")
+		}
+		return showCache(cache, args[0])
+	case "delete", "rm":
+		if len(args) == 0 {
+			return errors.New("usage: lrcd cache delete <pattern>...")
+		}
+		return deleteCache(cache, func(e *CacheEntry) bool {
+			for _, pattern := range args {
+				if matchEntry(pattern, e) {
+					return true
+				}
+			}
+			return false
+		})
+	case "purge":
+		flags := flag.NewFlagSet("purge", flag.ContinueOnError)
+		misses := flags.Bool("misses", false, "only delete tracks without lyrics")
+		err := flags.Parse(args)
+		if err != nil {
+			return err
+		}
+		return deleteCache(cache, func(e *CacheEntry) bool {
+			if !*misses {
+				return true
+			}
+			lyrics, _, err := cache.ReadEntry(e.Name)
+			return err != nil || lyrics.Len() == 0
+		})
+	case "export":
+		if len(args) != 1 {
+			return errors.New("usage: lrcd cache export <file.tar.gz>")
+		}
+		return exportCache(cache, args[0])
+	case "import":
+		if len(args) != 1 {
+			return errors.New("usage: lrcd cache import <file.tar.gz>")
+		}
+		return importCache(cache, args[0])
+	}
+	return fmt.Errorf("unknown cache command %q\n\n%s", cmd, cacheUsage)
+}
+
+func matchEntry(pattern string, e *CacheEntry) bool {
+	pattern = strings.ToLower(pattern)
+	key := strings.ToLower(e.Key)
+	if !strings.ContainsAny(pattern, "*?[") {
+		return strings.Contains(key, pattern)
+	}
+	ok, _ := path.Match(pattern, key)
+	return ok
+}
+
+func listCache(cache *Cache, pattern string) error {
+	entries, err := cache.Entries()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TRACK\tSOURCE\tLINES\tFETCHED")
+	for _, e := range entries {
+		if pattern != "" && !matchEntry(pattern, e) {
+			continue
+		}
+		lyrics, _, err := cache.ReadEntry(e.Name)
+		if err != nil {
+			fmt.Fprintf(w, "%s\t%v\t\t\n", e.Key, err)
+			continue
+		}
+		source := lyrics.Source
+		if lyrics.Instrumental {
+			source += " (instrumental)"
+		} else if lyrics.Unsynced {
+			source += " (unsynced)"
+		} else if lyrics.Len() == 0 {
+			source = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", e.Key, source, lyrics.Len(), lyrics.FetchedAt.Format(time.DateTime))
+	}
+	return w.Flush()
+}
+
+// findEntry returns the only entry matching the pattern
+func findEntry(cache *Cache, pattern string) (*CacheEntry, error) {
+	entries, err := cache.Entries()
+	if err != nil {
+		return nil, err
+	}
+	var matched []*CacheEntry
+	for _, e := range entries {
+		if matchEntry(pattern, e) {
+			matched = append(matched, e)
+		}
+	}
+	if len(matched) != 1 {
+		keys := make([]string, len(matched))
+		for i, e := range matched {
+			keys[i] = e.Key
+		}
+		return nil, fmt.Errorf("%d entries match %q\n%s", len(matched), pattern, strings.Join(keys, "\n"))
+	}
+	return matched[0], nil
+}
+
+func showCache(cache *Cache, pattern string) error {
+	entry, err := findEntry(cache, pattern)
+	if err != nil {
+		return err
+	}
+	lyrics, track, err := cache.ReadEntry(entry.Name)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(os.Stdout, lyrics.EnhancedLRC(track))
+	return err
+}
+
+func deleteCache(cache *Cache, match func(e *CacheEntry) bool) error {
+	entries, err := cache.Entries()
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, e := range entries {
+		if !match(e) {
+			continue
+		}
+		err = cache.Remove(e.Name)
+		if err != nil {
+			return err
+		}
+		n++
+	}
+	fmt.Printf("deleted %d entries\n", n)
+	return nil
+}
+
+func exportCache(cache *Cache, dst string) error {
+	entries, err := cache.Entries()
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	n := 0
+	for _, e := range entries {
+		lyrics, track, err := cache.ReadEntry(e.Name)
+		if err != nil {
+			slog.Warn("entry skipped", "track", e.Key, "error", err)
+			continue
+		}
+		// Misses are specific to this machine
+		if lyrics.Len() == 0 {
+			continue
+		}
+		if track.Title == "" {
+			slog.Warn("entry without track info skipped", "track", e.Key)
+			continue
+		}
+		data := lyrics.EnhancedLRC(track)
+		err = tw.WriteHeader(&tar.Header{
+			Name:    strings.TrimSuffix(utils.FormatFilename(track), ".cache") + ".lrc",
+			Mode:    0o644,
+			Size:    int64(len(data)),
+			ModTime: lyrics.FetchedAt,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(tw, data)
+		if err != nil {
+			return err
+		}
+		n++
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	err = gw.Close()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("exported %d entries\n", n)
+	return f.Close()
+}
+
+func importCache(cache *Cache, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(cache.path, 0o755)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gr)
+	n := 0
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg || filepath.Ext(header.Name) != ".lrc" {
+			continue
+		}
+		if header.Size > maxImportSize {
+			slog.Warn("file too large, skipped", "file", header.Name)
+			continue
+		}
+		buf, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		track, lyrics, err := parseCacheEntry(string(buf))
+		if err != nil {
+			slog.Warn("file skipped", "file", header.Name, "error", err)
+			continue
+		}
+		lyrics.FetchedAt = header.ModTime
+		err = cache.Set(track, lyrics)
+		if err != nil {
+			return err
+		}
+		n++
+	}
+	fmt.Printf("imported %d entries\n", n)
+	return nil
+}
+
+func parseCacheEntry(text string) (*models.MPRISMetadata, *models.Lyrics, error) {
+	lrc, err := utils.ParseLrc(text)
+	unsynced := errors.Is(err, utils.ErrNotSynced)
+	if unsynced {
+		lrc = utils.ParsePlain(text)
+		if len(lrc.Lines) == 0 {
+			return nil, nil, err
+		}
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if lrc.Title == "" || len(lrc.Artists) == 0 {
+		return nil, nil, errors.New("missing title or artist tags")
+	}
+	track := &models.MPRISMetadata{
+		Title:    lrc.Title,
+		Artists:  lrc.Artists,
+		Album:    lrc.Album,
+		Duration: lrc.Length,
+	}
+	lyrics := &models.Lyrics{Lines: lrc.Lines, Source: "import", Unsynced: unsynced}
+	if source := lrc.Tags["source"]; len(source) > 0 && source[0] != "" {
+		lyrics.Source = source[0]
+	}
+	return track, lyrics, nil
+}
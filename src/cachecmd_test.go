@@ -0,0 +1,67 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"lrcd/models"
+)
+
+func TestCacheExportImport(t *testing.T) {
+	src := &Cache{path: t.TempDir(), missTTL: time.Hour}
+	meta := &models.MPRISMetadata{
+		Title:    "春日影",
+		Artists:  []string{"CRYCHIC", "AC/DC"},
+		Album:    "春日影",
+		Duration: 246400 * time.Millisecond,
+	}
+	lyrics := &models.Lyrics{
+		Lines: []*models.LyricLine{
+			{Position: 1250, Text: "plain line"},
+			{Position: 65000, Text: "Hello world", Words: []*models.LyricWord{{Position: 65000, Text: "Hello "}, {Position: 65500, Text: "world"}}},
+		},
+		Source: "lrclib",
+	}
+	err := src.Set(meta, lyrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = src.Set(&models.MPRISMetadata{Title: "Miss", Artists: []string{"Artist"}}, &models.Lyrics{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "lyrics.tar.gz")
+	err = exportCache(src, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := &Cache{path: t.TempDir(), missTTL: time.Hour}
+	err = importCache(dst, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := dst.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	got, err := dst.Get(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Source != "lrclib" || got.Len() != 2 || got.Lines[0].Position != 1250 || len(got.Lines[1].Words) != 2 {
+		t.Errorf("unexpected lyrics %+v", got)
+	}
+	_, track, err := dst.ReadEntry(entries[0].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if track.Title != meta.Title || !slices.Equal(track.Artists, meta.Artists) || track.Album != meta.Album || track.Duration != meta.Duration {
+		t.Errorf("unexpected track %+v", track)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"log"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"time"
 
 	"lrcd/providers"
 	"lrcd/publishers"
@@ -12,48 +14,101 @@ import (
 	"go.yaml.in/yaml/v4"
 )
 
+// How long a track without lyrics is remembered before searching again
+const DefaultMissTTL = 24 * time.Hour
+
 type FetchMode int
 
 const (
 	FetchModeFallback FetchMode = iota
 	FetchModeFastest
+	FetchModeBest
 )
 
 type rawProvider struct {
-	ID string `yaml:"id"`
+	ID      string    `yaml:"id"`
+	Options yaml.Node `yaml:"options"`
 }
 
 type rawPublisher struct {
-	ID      string    `yaml:"id"`
-	Offset  int       `yaml:"offset"`
-	Options yaml.Node `yaml:"options"`
+	ID         string    `yaml:"id"`
+	Offset     int       `yaml:"offset"`
+	Karaoke    bool      `yaml:"karaoke"`
+	Lyrics     string    `yaml:"lyrics"`
+	Plain      string    `yaml:"plain"`
+	Separator  string    `yaml:"separator"`
+	ClearAfter int       `yaml:"clear_after"`
+	GapMarker  string    `yaml:"gap_marker"`
+	Options    yaml.Node `yaml:"options"`
+}
+
+type rawPlayers struct {
+	Allow    []string `yaml:"allow"`
+	Deny     []string `yaml:"deny"`
+	Priority []string `yaml:"priority"`
+	Policy   string   `yaml:"policy"`
 }
 
 type rawConfig struct {
-	LogLevel     string          `yaml:"log_level"`
-	FetchMode    string          `yaml:"fetch_mode"`
-	FetchTimeout int             `yaml:"fetch_timeout"`
-	ShowTitle    bool            `yaml:"show_title"`
-	UseCache     bool            `yaml:"use_cache"`
-	Filters      []string        `yaml:"filters"`
-	URLBlacklist []string        `yaml:"url_blacklist"`
-	Providers    []*rawProvider  `yaml:"providers"`
-	Publishers   []*rawPublisher `yaml:"publishers"`
+	LogLevel       string                  `yaml:"log_level"`
+	FetchMode      string                  `yaml:"fetch_mode"`
+	FetchTimeout   int                     `yaml:"fetch_timeout"`
+	MatchThreshold *float64                `yaml:"match_threshold"`
+	ShowTitle      bool                    `yaml:"show_title"`
+	PlainLyrics    bool                    `yaml:"plain_lyrics"`
+	UseCache       bool                    `yaml:"use_cache"`
+	MissTTL        *time.Duration          `yaml:"miss_ttl"`
+	CacheTTL       time.Duration           `yaml:"cache_ttl"`
+	CacheEntries   int                     `yaml:"cache_max_entries"`
+	CacheSize      int64                   `yaml:"cache_max_size"`
+	Filters        []string                `yaml:"filters"`
+	URLBlacklist   []string                `yaml:"url_blacklist"`
+	HTTP           providers.ClientOptions `yaml:"http"`
+	Providers      []*rawProvider          `yaml:"providers"`
+	Publishers     []*rawPublisher         `yaml:"publishers"`
+	Players        rawPlayers              `yaml:"players"`
 }
 
 func CreateProvider(p *rawProvider) (providers.Provider, error) {
 	var provider providers.Provider
 	switch p.ID {
-	case providers.MXMProviderID:
-		provider = providers.NewMXMProvider()
-	case providers.LRCLIBProviderID:
-		provider = providers.NewLRCLIBProvider()
+	case providers.MXMProviderID, providers.LRCLIBProviderID, providers.NCMProviderID, providers.KuwoProviderID:
+		opt := &providers.HTTPOptions{}
+		err := p.Options.Decode(opt)
+		if err != nil {
+			return nil, err
+		}
+		switch p.ID {
+		case providers.MXMProviderID:
+			provider = providers.NewMXMProvider(opt)
+		case providers.LRCLIBProviderID:
+			provider = providers.NewLRCLIBProvider(opt)
+		case providers.NCMProviderID:
+			provider = providers.NewNCMProvider(opt)
+		case providers.KuwoProviderID:
+			provider = providers.NewKuwoProvider(opt)
+		}
 	case providers.KugouProviderID:
-		provider = providers.NewKugouProvider()
-	case providers.NCMProviderID:
-		provider = providers.NewNCMProvider()
-	case providers.KuwoProviderID:
-		provider = providers.NewKuwoProvider()
+		opt := &providers.KugouProviderOptions{}
+		err := p.Options.Decode(opt)
+		if err != nil {
+			return nil, err
+		}
+		provider = providers.NewKugouProvider(opt)
+	case providers.EmbeddedProviderID:
+		provider = providers.NewEmbeddedProvider()
+	case providers.LocalProviderID:
+		opt := &providers.LocalProviderOptions{}
+		err := p.Options.Decode(opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range opt.Dirs {
+			if !filepath.IsAbs(dir) {
+				return nil, fmt.Errorf("lyrics directory %q must be absolute", dir)
+			}
+		}
+		provider = providers.NewLocalProvider(opt)
 	default:
 		return nil, fmt.Errorf("unknown provider %q", p.ID)
 	}
@@ -98,15 +153,22 @@ func CreatePublisher(p *rawPublisher) (publishers.Publisher, error) {
 }
 
 type Config struct {
-	LogLevel     slog.Level
-	FetchMode    FetchMode
-	FetchTimeout int
-	ShowTitle    bool
-	UseCache     bool
-	Filters      []string
-	URLBlacklist []string
-	Providers    []*ProviderEntry
-	Publishers   []*PublisherEntry
+	LogLevel       slog.Level
+	FetchMode      FetchMode
+	FetchTimeout   int
+	MatchThreshold float64
+	ShowTitle      bool
+	PlainLyrics    bool
+	UseCache       bool
+	MissTTL        time.Duration
+	CacheTTL       time.Duration
+	CacheEntries   int
+	CacheSize      int64
+	Filters        []string
+	URLBlacklist   []string
+	Providers      []*ProviderEntry
+	Publishers     []*PublisherEntry
+	Players        *PlayerSelector
 }
 
 func ParseConfig(path string) (*Config, error) {
@@ -121,6 +183,11 @@ func ParseConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
+	err = providers.Configure(&raw.HTTP)
+	if err != nil {
+		return nil, err
+	}
+
 	providers := make([]*ProviderEntry, 0, len(raw.Providers))
 	for _, p := range raw.Providers {
 		provider, err := CreateProvider(p)
@@ -133,12 +200,45 @@ func ParseConfig(path string) (*Config, error) {
 
 	publishers := make([]*PublisherEntry, 0, len(raw.Publishers))
 	for _, p := range raw.Publishers {
+		var mode LyricsMode
+		switch p.Lyrics {
+		case "original", "":
+			mode = LyricsModeOriginal
+		case "translation":
+			mode = LyricsModeTranslation
+		case "romanization":
+			mode = LyricsModeRomanization
+		case "both":
+			mode = LyricsModeBoth
+		default:
+			return nil, fmt.Errorf("unknown lyrics mode %q for publisher %q", p.Lyrics, p.ID)
+		}
+		var plain PlainMode
+		switch p.Plain {
+		case "estimate", "":
+			plain = PlainModeEstimate
+		case "block":
+			plain = PlainModeBlock
+		default:
+			return nil, fmt.Errorf("unknown plain lyrics mode %q for publisher %q", p.Plain, p.ID)
+		}
+		if p.ClearAfter < 0 {
+			return nil, fmt.Errorf("negative clear_after for publisher %q", p.ID)
+		}
 		publisher, err := CreatePublisher(p)
 		if err != nil {
 			log.Println(err)
 			continue
 		}
-		publishers = append(publishers, NewPublisherEntry(publisher, p.Offset))
+		publishers = append(publishers, NewPublisherEntry(publisher, &PublisherEntryOptions{
+			Offset:     p.Offset,
+			Karaoke:    p.Karaoke,
+			Lyrics:     mode,
+			Plain:      plain,
+			Separator:  p.Separator,
+			ClearAfter: p.ClearAfter,
+			GapMarker:  p.GapMarker,
+		}))
 	}
 
 	var fetchMode FetchMode
@@ -147,10 +247,33 @@ func ParseConfig(path string) (*Config, error) {
 		fetchMode = FetchModeFallback
 	case "fastest":
 		fetchMode = FetchModeFastest
+	case "best":
+		fetchMode = FetchModeBest
 	default:
 		return nil, fmt.Errorf("unknown fetch mode %q", raw.FetchMode)
 	}
 
+	matchThreshold := DefaultMatchThreshold
+	if raw.MatchThreshold != nil {
+		matchThreshold = *raw.MatchThreshold
+	}
+	if matchThreshold < 0 || matchThreshold > 1 {
+		return nil, fmt.Errorf("match threshold %v out of range [0, 1]", matchThreshold)
+	}
+
+	missTTL := DefaultMissTTL
+	if raw.MissTTL != nil {
+		missTTL = *raw.MissTTL
+	}
+	if raw.CacheTTL < 0 || raw.CacheEntries < 0 || raw.CacheSize < 0 {
+		return nil, fmt.Errorf("cache limits must not be negative")
+	}
+
+	selector, err := raw.Players.selector()
+	if err != nil {
+		return nil, err
+	}
+
 	var logLevel slog.Level
 	switch raw.LogLevel {
 	case "debug":
@@ -166,16 +289,56 @@ func ParseConfig(path string) (*Config, error) {
 	}
 
 	config := &Config{
-		LogLevel:     logLevel,
-		FetchMode:    fetchMode,
-		FetchTimeout: raw.FetchTimeout,
-		ShowTitle:    raw.ShowTitle,
-		UseCache:     raw.UseCache,
-		Filters:      raw.Filters,
-		URLBlacklist: raw.URLBlacklist,
-		Providers:    providers,
-		Publishers:   publishers,
+		LogLevel:       logLevel,
+		FetchMode:      fetchMode,
+		FetchTimeout:   raw.FetchTimeout,
+		MatchThreshold: matchThreshold,
+		ShowTitle:      raw.ShowTitle,
+		PlainLyrics:    raw.PlainLyrics,
+		UseCache:       raw.UseCache,
+		MissTTL:        missTTL,
+		CacheTTL:       raw.CacheTTL,
+		CacheEntries:   raw.CacheEntries,
+		CacheSize:      raw.CacheSize,
+		Filters:        raw.Filters,
+		URLBlacklist:   raw.URLBlacklist,
+		Providers:      providers,
+		Publishers:     publishers,
+		Players:        selector,
 	}
 
 	return config, nil
 }
+
+func (raw *rawPlayers) selector() (*PlayerSelector, error) {
+	var policy PlayerPolicy
+	switch raw.Policy {
+	case "recent", "":
+		policy = PlayerPolicyRecent
+	case "sticky":
+		policy = PlayerPolicySticky
+	default:
+		return nil, fmt.Errorf("unknown player policy %q", raw.Policy)
+	}
+	return &PlayerSelector{
+		Allow:    raw.Allow,
+		Deny:     raw.Deny,
+		Priority: raw.Priority,
+		Policy:   policy,
+	}, nil
+}
+
+// ParsePlayers only reads the players settings, for commands that shouldn't
+// set up providers and publishers
+func ParsePlayers(path string) (*PlayerSelector, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw rawConfig
+	err = yaml.Unmarshal(buf, &raw)
+	if err != nil {
+		return nil, err
+	}
+	return raw.Players.selector()
+}
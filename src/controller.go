@@ -1,11 +1,15 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
+	"os"
 	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"lrcd/models"
@@ -17,21 +21,73 @@ import (
 const (
 	ETX = "\x03"
 	EOT = "\x04"
+	US  = "\x1f"
+)
+
+var (
+	ErrNothingToBlacklist = errors.New("no matched candidate to blacklist")
+	ErrUnknownPublisher   = errors.New("unknown publisher")
+)
+
+// Number of accepted candidates per provider to download in FetchModeBest
+const maxBestCandidates = 3
+
+// Which track of the lyrics a publisher emits
+type LyricsMode int
+
+const (
+	LyricsModeOriginal LyricsMode = iota
+	LyricsModeTranslation
+	LyricsModeRomanization
+	LyricsModeBoth // Original followed by the translation
+)
+
+// How a publisher shows unsynced lyrics
+type PlainMode int
+
+const (
+	PlainModeEstimate PlainMode = iota // Spread across the track
+	PlainModeBlock                     // All lines at once, for publishers showing multiple lines
 )
 
 type PublisherEntry struct {
 	publishers.Publisher
-	ch        chan string
-	Offset    int
-	SentIndex int
+	ch            chan string
+	Offset        int
+	Karaoke       bool
+	Lyrics        LyricsMode
+	Plain         PlainMode
+	Separator     string // Between the original and the translation in LyricsModeBoth
+	ClearAfter    int    // Silence after the end of a line before sending GapMarker, 0 to disable
+	GapMarker     string // Sent instead of the line during gaps, such as "♪"
+	SentIndex     int
+	SentWordIndex int
+	SentGap       bool
+}
+
+type PublisherEntryOptions struct {
+	Offset     int
+	Karaoke    bool
+	Lyrics     LyricsMode
+	Plain      PlainMode
+	Separator  string
+	ClearAfter int
+	GapMarker  string
 }
 
-func NewPublisherEntry(publisher publishers.Publisher, offset int) *PublisherEntry {
+func NewPublisherEntry(publisher publishers.Publisher, opt *PublisherEntryOptions) *PublisherEntry {
 	p := &PublisherEntry{
-		Publisher: publisher,
-		ch:        make(chan string, 16),
-		Offset:    offset,
-		SentIndex: -1,
+		Publisher:     publisher,
+		ch:            make(chan string, 16),
+		Offset:        opt.Offset,
+		Karaoke:       opt.Karaoke,
+		Lyrics:        opt.Lyrics,
+		Plain:         opt.Plain,
+		Separator:     cmp.Or(opt.Separator, "\n"),
+		ClearAfter:    opt.ClearAfter,
+		GapMarker:     opt.GapMarker,
+		SentIndex:     -1,
+		SentWordIndex: -1,
 	}
 	go func() {
 		for txt := range p.ch {
@@ -44,6 +100,36 @@ func NewPublisherEntry(publisher publishers.Publisher, offset int) *PublisherEnt
 	return p
 }
 
+// In karaoke mode, the sung part and the remaining part of a line are separated
+// by US. Lines without the chosen secondary track fall back to the original.
+func (p *PublisherEntry) SendLine(lyrics *models.Lyrics, index int, wordIndex int) {
+	var secondary string
+	switch p.Lyrics {
+	case LyricsModeTranslation, LyricsModeBoth:
+		secondary = lyrics.GetTranslation(index)
+	case LyricsModeRomanization:
+		secondary = lyrics.GetRomanization(index)
+	}
+	if secondary != "" && p.Lyrics != LyricsModeBoth {
+		p.Send(secondary)
+		return
+	}
+	text := lyrics.Get(index)
+	if wordIndex != -1 {
+		sung, rest := lyrics.GetWords(index, wordIndex)
+		text = sung + US + rest
+	}
+	if secondary != "" {
+		text += p.Separator + secondary
+	}
+	p.Send(text)
+}
+
+// SendGap replaces the line that has ended, the marker is empty unless configured
+func (p *PublisherEntry) SendGap() {
+	p.Send(p.GapMarker)
+}
+
 func (p *PublisherEntry) Send(txt string) {
 	select {
 	case p.ch <- txt:
@@ -62,46 +148,53 @@ func (p *PublisherEntry) Exit() {
 	p.Publisher.Exit()
 }
 
-type ProviderEntry struct {
-	providers.Provider
-}
-
-func NewProviderEntry(provider providers.Provider) *ProviderEntry {
-	return &ProviderEntry{
-		Provider: provider,
-	}
-}
-
 type Controller struct {
-	propsCh       <-chan models.MPRISProperties
-	providers     []*ProviderEntry
-	fetchMode     FetchMode
-	fetchTimeout  int
-	publishers    []*PublisherEntry
-	showTitle     bool
-	filterMatcher *utils.Matcher
-	urlMatcher    *utils.Matcher
-	cache         *Cache
-	lyrics        *models.Lyrics
-	props         models.MPRISProperties
-	position      int
+	propsCh        <-chan models.MPRISProperties
+	providers      []*ProviderEntry
+	fetchMode      FetchMode
+	fetchTimeout   int
+	matchThreshold float64
+	publishers     []*PublisherEntry
+	showTitle      bool
+	plainLyrics    bool
+	filterMatcher  *utils.Matcher
+	urlMatcher     *utils.Matcher
+	cache          *Cache
+	overrides      *Overrides
+	refreshing     map[string]bool
+	lyrics         *models.Lyrics
+	block          *models.Lyrics // Unsynced lyrics laid out for PlainModeBlock
+	props          models.MPRISProperties
+	position       int       // milli, reported by the player at anchor
+	anchor         time.Time // Monotonic reference the position is extrapolated from
+	wake           chan struct{}
+	paused         bool // Publishing paused by the user, the status is still tracked
+	lineIndex      int  // Current line without publisher offsets, for Status
+	changed        chan struct{}
 
 	mu               sync.Mutex
-	cancelTicking    context.CancelFunc
+	cancelSending    context.CancelFunc
 	cancelFetching   context.CancelFunc
 	currentRequestID int
 }
 
 type ControllerOptions struct {
-	propsCh      <-chan models.MPRISProperties
-	providers    []*ProviderEntry
-	publishers   []*PublisherEntry
-	fetchMode    FetchMode
-	fetchTimeout int
-	filters      []string
-	urlBlacklist []string
-	showTitle    bool
-	cacheDir     string
+	propsCh        <-chan models.MPRISProperties
+	providers      []*ProviderEntry
+	publishers     []*PublisherEntry
+	fetchMode      FetchMode
+	fetchTimeout   int
+	matchThreshold float64
+	filters        []string
+	urlBlacklist   []string
+	showTitle      bool
+	plainLyrics    bool
+	cacheDir       string
+	overridesDir   string
+	missTTL        time.Duration
+	cacheTTL       time.Duration
+	cacheEntries   int
+	cacheBytes     int64
 }
 
 func NewController(opt *ControllerOptions) *Controller {
@@ -109,7 +202,23 @@ func NewController(opt *ControllerOptions) *Controller {
 	var filterMatcher *utils.Matcher
 	var urlMatcher *utils.Matcher
 	if opt.cacheDir != "" {
-		cache = &Cache{path: opt.cacheDir}
+		cache = &Cache{
+			path:       opt.cacheDir,
+			missTTL:    opt.missTTL,
+			ttl:        opt.cacheTTL,
+			maxEntries: opt.cacheEntries,
+			maxBytes:   opt.cacheBytes,
+		}
+		go func() {
+			err := cache.Evict()
+			if err != nil {
+				slog.Warn("failed to evict cache", "error", err)
+			}
+		}()
+	}
+	var overrides *Overrides
+	if opt.overridesDir != "" {
+		overrides = NewOverrides(opt.overridesDir)
 	}
 	if len(opt.filters) > 0 {
 		filterMatcher = utils.NewStringMatcher(opt.filters)
@@ -118,59 +227,45 @@ func NewController(opt *ControllerOptions) *Controller {
 		urlMatcher = utils.NewStringMatcher(opt.urlBlacklist)
 	}
 	return &Controller{
-		propsCh:       opt.propsCh,
-		providers:     opt.providers,
-		publishers:    opt.publishers,
-		fetchMode:     opt.fetchMode,
-		fetchTimeout:  opt.fetchTimeout,
-		showTitle:     opt.showTitle,
-		filterMatcher: filterMatcher,
-		urlMatcher:    urlMatcher,
-		cache:         cache,
-	}
-}
-
-func (c *Controller) checkCandidate(meta *models.MPRISMetadata, candidate *models.Candidate, altTitle string, artistSet map[string]struct{}) bool {
-	titleMatched := false
-	artistMatched := false
-	for _, t := range candidate.Titles {
-		if t == meta.Title || utils.StripTitle(t) == altTitle {
-			titleMatched = true
-			break
-		}
-	}
-	if !titleMatched {
-		return false
-	}
-	for _, a := range candidate.Artists {
-		if _, ok := artistSet[a]; ok {
-			artistMatched = true
-			break
-		}
-	}
-	if !artistMatched {
-		return false
+		propsCh:        opt.propsCh,
+		providers:      opt.providers,
+		publishers:     opt.publishers,
+		fetchMode:      opt.fetchMode,
+		fetchTimeout:   opt.fetchTimeout,
+		matchThreshold: opt.matchThreshold,
+		showTitle:      opt.showTitle,
+		plainLyrics:    opt.plainLyrics,
+		filterMatcher:  filterMatcher,
+		urlMatcher:     urlMatcher,
+		cache:          cache,
+		overrides:      overrides,
+		refreshing:     map[string]bool{},
+		anchor:         time.Now(),
+		wake:           make(chan struct{}, 1),
+		lineIndex:      -1,
+		changed:        make(chan struct{}, 1),
 	}
-	if (meta.Duration - candidate.Duration).Abs() > 2*time.Second {
-		return false
-	}
-	return true
 }
 
-func (c *Controller) fetchFastest(ctx context.Context, meta *models.MPRISMetadata) *models.Lyrics {
-	altTitle := utils.StripTitle(meta.Title)
-	artistSet := map[string]struct{}{}
-	for _, a := range meta.Artists {
-		artistSet[a] = struct{}{}
-	}
-	trackname := utils.FormatTrack(meta)
+func (c *Controller) fetchFastest(ctx context.Context, meta *models.MPRISMetadata) (*models.Lyrics, bool) {
+	query := newTrackQuery(meta)
+	trackname := query.name
+	failed := atomic.Bool{}
 	wg := sync.WaitGroup{}
-	lyricsCh := make(chan *models.Lyrics, len(c.providers))
+	lyricsCh := make(chan *models.Lyrics, 2*len(c.providers))
 	for _, prov := range c.providers {
+		if !prov.Allow() {
+			slog.Info("provider skipped", "track", trackname, "source", prov.ID(), "state", prov.Health().State)
+			failed.Store(true)
+			continue
+		}
 		slog.Info("fetching lyrics", "track", trackname, "source", prov.ID())
 		wg.Go(func() {
 			iter, err := prov.IterAll(ctx, meta)
 			if err != nil {
+				if isFailure(err) {
+					failed.Store(true)
+				}
 				if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 					slog.Warn("fetch canceled", "track", trackname)
 				} else {
@@ -178,19 +273,32 @@ func (c *Controller) fetchFastest(ctx context.Context, meta *models.MPRISMetadat
 				}
 				return
 			}
+			plain := false
 			for candidate := range iter {
-				if !c.checkCandidate(meta, candidate, altTitle, artistSet) {
+				if c.blocked(meta, prov.ID(), candidate) || query.Score(candidate, prov.ID()) < c.matchThreshold {
 					continue
 				}
 				lyrics, err := candidate.Lyrics(ctx)
 				if err != nil {
+					if isFailure(err) {
+						failed.Store(true)
+					}
 					if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 						slog.Warn("fetch canceled", "track", trackname)
 						return
 					}
 					continue
 				}
+				if lyrics.Unsynced && plain {
+					continue
+				}
+				lyrics.Match = candidate.Info()
 				lyricsCh <- lyrics
+				if !lyrics.Unsynced {
+					return
+				}
+				// Keep looking for synced lyrics
+				plain = true
 			}
 		})
 	}
@@ -198,72 +306,215 @@ func (c *Controller) fetchFastest(ctx context.Context, meta *models.MPRISMetadat
 		wg.Wait()
 		close(lyricsCh)
 	}()
-	return <-lyricsCh
+	var plain *models.Lyrics
+	for lyrics := range lyricsCh {
+		if !lyrics.Unsynced {
+			return lyrics, true
+		}
+		if plain == nil {
+			plain = lyrics
+		}
+	}
+	return plain, plain != nil || !failed.Load()
 }
 
-func (c *Controller) fetchFallback(ctx context.Context, meta *models.MPRISMetadata) *models.Lyrics {
-	altTitle := utils.StripTitle(meta.Title)
-	artistSet := map[string]struct{}{}
-	for _, a := range meta.Artists {
-		artistSet[a] = struct{}{}
+// Unsynced lyrics are only used if no synced lyrics are found. They are cached
+// either way and dropped when read unless enabled, so enabling them takes
+// effect without waiting for the miss to expire.
+func (c *Controller) acceptPlain(lyrics *models.Lyrics) bool {
+	return !lyrics.Unsynced || c.plainLyrics
+}
+
+func (c *Controller) fetchBest(ctx context.Context, meta *models.MPRISMetadata) (*models.Lyrics, bool) {
+	query := newTrackQuery(meta)
+	trackname := query.name
+	failed := atomic.Bool{}
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	var ranked []rankedLyrics
+	for _, prov := range c.providers {
+		if !prov.Allow() {
+			slog.Info("provider skipped", "track", trackname, "source", prov.ID(), "state", prov.Health().State)
+			failed.Store(true)
+			continue
+		}
+		slog.Info("fetching lyrics", "track", trackname, "source", prov.ID())
+		wg.Go(func() {
+			iter, err := prov.IterAll(ctx, meta)
+			if err != nil {
+				if isFailure(err) {
+					failed.Store(true)
+				}
+				if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+					slog.Warn("fetch canceled", "track", trackname)
+				} else {
+					slog.Warn(err.Error(), "track", trackname, "source", prov.ID())
+				}
+				return
+			}
+			fetched := 0
+			for candidate := range iter {
+				if c.blocked(meta, prov.ID(), candidate) {
+					continue
+				}
+				score := query.Score(candidate, prov.ID())
+				if score < c.matchThreshold {
+					continue
+				}
+				lyrics, err := candidate.Lyrics(ctx)
+				if err != nil {
+					if isFailure(err) {
+						failed.Store(true)
+					}
+					if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+						slog.Warn("fetch canceled", "track", trackname)
+						return
+					}
+					continue
+				}
+				lyrics.Match = candidate.Info()
+				slog.Debug("lyrics ranked", "track", trackname, "source", prov.ID(), "lines", lyrics.Len(), "score", score, "features", lyricsFeatures(lyrics))
+				mu.Lock()
+				ranked = append(ranked, rankedLyrics{lyrics: lyrics, score: score})
+				mu.Unlock()
+				fetched++
+				if fetched >= maxBestCandidates {
+					return
+				}
+			}
+		})
 	}
-	trackname := utils.FormatTrack(meta)
+	wg.Wait()
+	best := pickBest(ranked)
+	return best, best != nil || !failed.Load()
+}
+
+func (c *Controller) fetchFallback(ctx context.Context, meta *models.MPRISMetadata) (*models.Lyrics, bool) {
+	query := newTrackQuery(meta)
+	trackname := query.name
+	failed := false
+	var plain *models.Lyrics
 	for _, prov := range c.providers {
+		if !prov.Allow() {
+			slog.Info("provider skipped", "track", trackname, "source", prov.ID(), "state", prov.Health().State)
+			failed = true
+			continue
+		}
 		slog.Info("fetching lyrics", "track", trackname, "source", prov.ID())
 		iter, err := prov.IterAll(ctx, meta)
 		if err != nil {
 			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 				slog.Warn("fetch canceled", "track", trackname)
-				return nil
+				return nil, false
+			}
+			if isFailure(err) {
+				failed = true
 			}
 			slog.Warn(err.Error(), "track", trackname, "source", prov.ID())
 			continue
 		}
 		for candidate := range iter {
-			if !c.checkCandidate(meta, candidate, altTitle, artistSet) {
+			if c.blocked(meta, prov.ID(), candidate) || query.Score(candidate, prov.ID()) < c.matchThreshold {
 				continue
 			}
 			lyrics, err := candidate.Lyrics(ctx)
 			if err != nil {
 				if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 					slog.Warn("fetch canceled", "track", trackname)
-					return nil
+					return nil, false
+				}
+				if isFailure(err) {
+					failed = true
+				}
+				continue
+			}
+			lyrics.Match = candidate.Info()
+			if lyrics.Unsynced {
+				// Keep looking for synced lyrics
+				if plain == nil {
+					plain = lyrics
 				}
 				continue
 			}
-			return lyrics
+			return lyrics, true
 		}
 	}
-	return nil
+	if plain != nil {
+		return plain, true
+	}
+	return nil, !failed
 }
 
+func (c *Controller) blocked(meta *models.MPRISMetadata, source string, candidate *models.Candidate) bool {
+	if !c.overrides.Blocked(meta, source, candidate.ID) {
+		return false
+	}
+	slog.Info("candidate blacklisted", "track", utils.FormatTrack(meta), "source", source, "id", candidate.ID)
+	return true
+}
+
+// Failures make a miss inconclusive, so it won't be cached
+func isFailure(err error) bool {
+	return !errors.Is(err, providers.ErrNoLyrics) && !errors.Is(err, providers.ErrParseFailure)
+}
+
+// The returned bool reports whether the result should be cached, a nil result
+// is cached as a miss
 func (c *Controller) fetchLyrics(meta *models.MPRISMetadata, reqID int) (*models.Lyrics, bool) {
+	lyrics, err := c.overrides.Get(meta)
+	if err == nil {
+		slog.Info("got override", "track", utils.FormatTrack(meta))
+		return lyrics, false
+	} else if !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("failed to read override", "error", err)
+	}
+	var missed *models.Lyrics
 	if c.cache != nil {
 		lyrics, err := c.cache.Get(meta)
-		if err == nil {
-			slog.Info("got cache", "track", utils.FormatTrack(meta))
-			return lyrics, false
+		if err == nil && lyrics.Len() > 0 {
+			slog.Info("got cache", "track", utils.FormatTrack(meta), "unsynced", lyrics.Unsynced)
+			if c.cache.Stale(lyrics) {
+				go c.refresh(*meta, lyrics)
+			}
+			if c.acceptPlain(lyrics) {
+				return lyrics, false
+			}
+			// Synced lyrics may still come from MPRIS
+			missed = &models.Lyrics{}
+		} else if err == nil && lyrics.Len() == 0 {
+			slog.Info("got negative cache", "track", utils.FormatTrack(meta), "instrumental", lyrics.Instrumental)
+			missed = lyrics
 		}
 	}
 	if meta.Text != "" {
-		lines, err := utils.ParseLrc(meta.Text)
+		lrc, err := utils.ParseLyrics(meta.Text)
 		if err == nil {
-			return &models.Lyrics{
-				Lines:  lines,
-				Source: "mpris",
-			}, false
+			// ID tags, if any, must agree with the track
+			if newTrackQuery(meta).Score(lrc.Candidate(meta), "mpris") >= c.matchThreshold {
+				return &models.Lyrics{
+					Lines:  lrc.Lines,
+					Source: "mpris",
+				}, false
+			}
+			slog.Info("mpris lyrics mismatch", "track", utils.FormatTrack(meta), "title", lrc.Title, "artists", lrc.Artists)
+		} else if errors.Is(err, utils.ErrNotSynced) && c.plainLyrics {
+			lrc := utils.ParsePlain(meta.Text)
+			if len(lrc.Lines) > 0 && newTrackQuery(meta).Score(lrc.Candidate(meta), "mpris") >= c.matchThreshold {
+				return &models.Lyrics{
+					Lines:    lrc.Lines,
+					Source:   "mpris",
+					Unsynced: true,
+				}, false
+			}
 		}
 	}
+	if missed != nil {
+		return missed, false
+	}
 	if len(c.providers) == 0 {
 		return nil, false
 	}
-	var ctx context.Context
-	var cancel context.CancelFunc
-	if c.fetchTimeout > 0 {
-		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(c.fetchTimeout)*time.Millisecond)
-	} else {
-		ctx, cancel = context.WithCancel(context.Background())
-	}
+	ctx, cancel := c.fetchContext()
 	c.mu.Lock()
 	if reqID != c.currentRequestID {
 		cancel()
@@ -277,103 +528,442 @@ func (c *Controller) fetchLyrics(meta *models.MPRISMetadata, reqID int) (*models
 	c.cancelFetching = cancel
 	c.mu.Unlock()
 
+	lyrics, conclusive := c.fetchProviders(ctx, meta)
+	if lyrics == nil {
+		return nil, conclusive && ctx.Err() == nil
+	}
+	// Local files are cheap to read and may be edited at any time, so don't cache them
+	return lyrics, !providers.IsOffline(lyrics.Source)
+}
+
+func (c *Controller) fetchContext() (context.Context, context.CancelFunc) {
+	if c.fetchTimeout > 0 {
+		return context.WithTimeout(context.Background(), time.Duration(c.fetchTimeout)*time.Millisecond)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// A miss is inconclusive if any search failed, including the ones lazy
+// providers report while they are iterated
+func (c *Controller) fetchProviders(ctx context.Context, meta *models.MPRISMetadata) (*models.Lyrics, bool) {
+	// Provider health only changes while fetching
+	defer c.notify()
+	failed := atomic.Bool{}
+	ctx = providers.WithFailures(ctx, func(err error) {
+		if isFailure(err) {
+			failed.Store(true)
+		}
+	})
+	var lyrics *models.Lyrics
+	var conclusive bool
 	switch c.fetchMode {
 	case FetchModeFallback:
-		return c.fetchFallback(ctx, meta), true
+		lyrics, conclusive = c.fetchFallback(ctx, meta)
 	case FetchModeFastest:
-		return c.fetchFastest(ctx, meta), true
+		lyrics, conclusive = c.fetchFastest(ctx, meta)
+	case FetchModeBest:
+		lyrics, conclusive = c.fetchBest(ctx, meta)
 	}
+	if lyrics == nil && failed.Load() {
+		return nil, false
+	}
+	return lyrics, conclusive
+}
+
+// Refresh stale cached lyrics without disturbing the playback, the stale copy
+// is kept if nothing better is found
+func (c *Controller) refresh(meta models.MPRISMetadata, stale *models.Lyrics) {
+	trackStr := utils.FormatTrack(&meta)
+	key := utils.FormatFilename(&meta)
 	c.mu.Lock()
-	if c.cancelFetching != nil {
-		c.cancelFetching()
-		c.cancelFetching = nil
+	if c.refreshing[key] {
+		c.mu.Unlock()
+		return
 	}
+	c.refreshing[key] = true
 	c.mu.Unlock()
-	return nil, false
+	defer func() {
+		c.mu.Lock()
+		delete(c.refreshing, key)
+		c.mu.Unlock()
+	}()
+	slog.Info("refreshing cache", "track", trackStr)
+	ctx, cancel := c.fetchContext()
+	defer cancel()
+	lyrics, conclusive := c.fetchProviders(ctx, &meta)
+	if lyrics == nil || lyrics.Len() == 0 || providers.IsOffline(lyrics.Source) || (lyrics.Unsynced && !stale.Unsynced) {
+		if !conclusive || ctx.Err() != nil {
+			return
+		}
+		// Keep the stale copy for another period
+		refreshed := *stale
+		refreshed.FetchedAt = time.Time{}
+		lyrics = &refreshed
+	}
+	slog.Info("cache refreshed", "track", trackStr, "source", lyrics.Source)
+	err := c.cache.Set(&meta, lyrics)
+	if err != nil {
+		slog.Warn("failed to set cache", "error", err)
+	}
 }
 
+// Player positions differing less than this from the extrapolated position
+// are ignored, so that polling doesn't make words flicker back and forth
+const driftTolerance = 50 // milli
+
+// Must be called with c.mu held
+func (c *Controller) currentPosition() int {
+	if c.props.PlaybackStatus != models.PlaybackStatusPlaying {
+		return c.position
+	}
+	return c.position + int(float64(time.Since(c.anchor).Milliseconds())*c.props.PlaybackRate())
+}
+
+// Must be called with c.mu held
+func (c *Controller) reanchor(position int) {
+	c.position = position
+	c.anchor = time.Now()
+}
+
+// reschedule wakes timedSend up after the position changed
+func (c *Controller) reschedule() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// lyricsFor returns the lyrics as laid out for the publisher, must be called
+// with c.mu held
+func (c *Controller) lyricsFor(p *PublisherEntry) *models.Lyrics {
+	if c.block != nil && p.Plain == PlainModeBlock {
+		return c.block
+	}
+	return c.lyrics
+}
+
+// stateOf returns the line, word and gap the publisher should show at the
+// position, must be called with c.mu held
+func (c *Controller) stateOf(p *PublisherEntry, position int) (int, int, bool) {
+	lyrics := c.lyricsFor(p)
+	idx := lyrics.IndexOf(position, p.Offset)
+	wIdx := -1
+	if p.Karaoke {
+		wIdx = lyrics.WordIndexOf(idx, position, p.Offset)
+	}
+	// The intro before the first line is a gap as well
+	gap := false
+	if p.ClearAfter > 0 {
+		end := 0
+		if idx >= 0 {
+			end = lyrics.EndOf(idx)
+		}
+		gap = position-p.Offset >= end+p.ClearAfter
+	}
+	return idx, wIdx, gap
+}
+
+// Must be called with c.mu held
+func (c *Controller) update(p *PublisherEntry, position int) {
+	idx, wIdx, gap := c.stateOf(p, position)
+	if idx == p.SentIndex && wIdx == p.SentWordIndex && gap == p.SentGap {
+		return
+	}
+	p.SentIndex = idx
+	p.SentWordIndex = wIdx
+	p.SentGap = gap
+	if gap {
+		p.SendGap()
+	} else {
+		p.SendLine(c.lyricsFor(p), idx, wIdx)
+	}
+}
+
+// nextChange returns how long until the state sent to the publisher changes,
+// or -1 if it won't. Lines and words start right after their position, see
+// IndexOf. Must be called with c.mu held, after update.
+func (c *Controller) nextChange(p *PublisherEntry, position int) int {
+	offPos := position - p.Offset
+	next := -1
+	consider := func(target int) {
+		if d := target - offPos; d > 0 && (next < 0 || d < next) {
+			next = d
+		}
+	}
+	lyrics := c.lyricsFor(p)
+	idx := p.SentIndex
+	if idx+1 < lyrics.Len() {
+		consider(lyrics.Lines[idx+1].Position + 1)
+	}
+	if p.Karaoke && idx >= 0 {
+		words := lyrics.Lines[idx].Words
+		if p.SentWordIndex+1 < len(words) {
+			consider(words[p.SentWordIndex+1].Position + 1)
+		}
+	}
+	if p.ClearAfter > 0 && !p.SentGap {
+		end := 0
+		if idx >= 0 {
+			end = lyrics.EndOf(idx)
+		}
+		consider(end + p.ClearAfter)
+	}
+	return next
+}
+
+// trackLine follows the current line for Status, and returns how long until it
+// changes or -1 if it won't. Must be called with c.mu held.
+func (c *Controller) trackLine(position int) int {
+	idx := c.lyrics.IndexOf(position, 0)
+	if idx != c.lineIndex {
+		c.lineIndex = idx
+		c.notify()
+	}
+	if idx+1 < c.lyrics.Len() {
+		return c.lyrics.Lines[idx+1].Position + 1 - position
+	}
+	return -1
+}
+
+// timedSend sends line changes as they happen, sleeping until the next change
+// of any publisher. It is woken up to reschedule when the position changes.
 func (c *Controller) timedSend() {
 	c.mu.Lock()
-	if c.cancelTicking != nil {
-		c.cancelTicking()
+	if c.cancelSending != nil {
+		c.cancelSending()
 	}
 	ctx, cancel := context.WithCancel(context.Background())
-	c.cancelTicking = cancel
+	c.cancelSending = cancel
 	c.mu.Unlock()
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer func() {
-		if c.cancelTicking != nil {
-			c.cancelTicking()
-			c.cancelTicking = nil
-		}
-		ticker.Stop()
-	}()
+	defer cancel()
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
 	for {
-		select {
-		case <-ctx.Done():
+		c.mu.Lock()
+		if c.lyrics == nil || ctx.Err() != nil {
+			c.mu.Unlock()
 			return
-		case <-ticker.C:
-			c.mu.Lock()
-			if c.lyrics == nil {
-				c.mu.Unlock()
-				return
-			}
-			c.position += 100
-			allDone := true
+		}
+		position := c.currentPosition()
+		rate := c.props.PlaybackRate()
+		delay := c.trackLine(position)
+		if !c.paused {
 			for _, p := range c.publishers {
-				idx := c.lyrics.IndexOf(c.position, p.Offset)
-				if idx < c.lyrics.Len()-1 {
-					allDone = false
+				c.update(p, position)
+				if d := c.nextChange(p, position); d >= 0 && (delay < 0 || d < delay) {
+					delay = d
 				}
-				if idx == p.SentIndex {
-					continue
-				}
-				p.SentIndex = idx
-				p.Send(c.lyrics.Get(idx))
-			}
-			if allDone {
-				c.mu.Unlock()
-				return
 			}
-			c.mu.Unlock()
+		}
+		c.mu.Unlock()
+		// Past the last change, wait for a seek
+		if delay < 0 {
+			timer.Stop()
+		} else {
+			// Delays are in track time
+			timer.Reset(time.Duration(float64(delay) / rate * float64(time.Millisecond)))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-c.wake:
 		}
 	}
 }
 
 func (c *Controller) resetAll() {
-	if c.cancelTicking != nil {
-		c.cancelTicking()
-		c.cancelTicking = nil
+	if c.cancelSending != nil {
+		c.cancelSending()
+		c.cancelSending = nil
 	}
 	if c.cancelFetching != nil {
 		c.cancelFetching()
 		c.cancelFetching = nil
 	}
-	c.position = 0
+	c.reanchor(0)
 	c.lyrics = nil
+	c.block = nil
+	c.lineIndex = -1
+	c.notify()
 	for _, publisher := range c.publishers {
 		publisher.SentIndex = -1
+		publisher.SentWordIndex = -1
+		publisher.SentGap = false
 		publisher.Clear()
 	}
 }
 
+// Filtered lines are dropped before unsynced lyrics are laid out, must be
+// called with c.mu held
 func (c *Controller) setLyrics(lyrics *models.Lyrics) {
-	if c.filterMatcher == nil {
-		c.lyrics = lyrics
+	if c.filterMatcher != nil {
+		lines := slices.Clone(lyrics.Lines)
+		n := 0
+		for _, line := range lines {
+			if !c.filterMatcher.Contains([]byte(line.Text)) {
+				lines[n] = line
+				n++
+			}
+		}
+		filtered := *lyrics
+		filtered.Lines = lines[:n]
+		lyrics = &filtered
+	}
+	c.block = nil
+	if lyrics.Unsynced {
+		c.block = lyrics.Block(c.props.Metadata.Duration)
+		lyrics = lyrics.EstimateTiming(c.props.Metadata.Duration)
+	}
+	c.lyrics = lyrics
+	c.notify()
+}
+
+// Must be called with c.mu held
+func (c *Controller) fetch(meta models.MPRISMetadata) {
+	trackStr := utils.FormatTrack(&meta)
+	c.currentRequestID++
+	currentReqID := c.currentRequestID
+	go func() {
+		lyrics, shouldCache := c.fetchLyrics(&meta, currentReqID)
+		if c.cache != nil && shouldCache {
+			if lyrics == nil {
+				slog.Info("set negative cache", "track", trackStr)
+				go c.cache.Set(&meta, &models.Lyrics{})
+			} else {
+				slog.Info("set cache", "track", trackStr, "source", lyrics.Source)
+				go c.cache.Set(&meta, lyrics)
+			}
+		}
+		if lyrics != nil && !c.acceptPlain(lyrics) {
+			slog.Info("plain lyrics ignored", "track", trackStr, "source", lyrics.Source)
+			lyrics = nil
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if currentReqID != c.currentRequestID {
+			slog.Info("request discarded", "track", trackStr)
+			return
+		}
+		if lyrics == nil || lyrics.Len() == 0 {
+			slog.Info("no lyrics available", "track", trackStr, "instrumental", lyrics != nil && lyrics.Instrumental)
+			return
+		}
+		slog.Info("got lyrics", "track", trackStr, "source", lyrics.Source, "unsynced", lyrics.Unsynced)
+		c.setLyrics(lyrics)
+		if c.props.PlaybackStatus == models.PlaybackStatusPlaying {
+			go c.timedSend()
+		}
+	}()
+}
+
+// Refetch drops the cached result of the current track and fetches it again
+func (c *Controller) Refetch() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refetchLocked(c.props.Metadata.Clone())
+}
+
+// Must be called with c.mu held, meta being the current track
+func (c *Controller) refetchLocked(meta models.MPRISMetadata) {
+	if meta.Title == "" || len(meta.Artists) == 0 {
 		return
 	}
-	filtered := slices.Clone(lyrics.Lines)
-	n := 0
-	for _, line := range filtered {
-		if !c.filterMatcher.Contains([]byte(line.Text)) {
-			filtered[n] = line
-			n++
+	if c.urlMatcher != nil && c.urlMatcher.Contains([]byte(meta.URL)) {
+		return
+	}
+	slog.Info("refetching", "track", utils.FormatTrack(&meta))
+	if c.cache != nil {
+		err := c.cache.Delete(&meta)
+		if err != nil {
+			slog.Warn("failed to delete cache", "error", err)
+		}
+	}
+	position := c.currentPosition()
+	c.resetAll()
+	c.reanchor(position)
+	c.fetch(meta)
+}
+
+// Blacklist rejects the lyrics shown for the current track and fetches again,
+// skipping the rejected candidate from now on. The lock is held throughout so
+// that the track can't change in between.
+func (c *Controller) Blacklist() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lyrics == nil || c.lyrics.Match == nil || c.lyrics.Match.ID == "" || c.overrides == nil {
+		return ErrNothingToBlacklist
+	}
+	meta := c.props.Metadata.Clone()
+	source, id := c.lyrics.Source, c.lyrics.Match.ID
+	slog.Info("blacklisting", "track", utils.FormatTrack(&meta), "source", source, "id", id)
+	err := c.overrides.Block(&meta, source, id)
+	if err != nil {
+		return fmt.Errorf("failed to blacklist: %w", err)
+	}
+	c.refetchLocked(meta)
+	return nil
+}
+
+// SetOffset changes the offset of every publisher with the ID
+func (c *Controller) SetOffset(id string, offset int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	found := false
+	for _, p := range c.publishers {
+		if p.ID() == id {
+			p.Offset = offset
+			found = true
 		}
 	}
-	c.lyrics = &models.Lyrics{
-		Source: lyrics.Source,
-		Lines:  filtered[:n],
+	if !found {
+		return fmt.Errorf("%w %q", ErrUnknownPublisher, id)
 	}
+	slog.Info("offset changed", "publisher", id, "offset", offset)
+	c.notify()
+	c.reschedule()
+	return nil
+}
+
+// Pause clears the publishers and stops sending lines until Resume
+func (c *Controller) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused {
+		return
+	}
+	slog.Info("publishing paused")
+	c.paused = true
+	for _, p := range c.publishers {
+		p.Clear()
+	}
+	c.notify()
+}
+
+func (c *Controller) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.paused {
+		return
+	}
+	slog.Info("publishing resumed")
+	c.paused = false
+	// Publishers were cleared, send whatever is current again
+	for _, p := range c.publishers {
+		p.SentIndex = -1
+		p.SentWordIndex = -1
+		p.SentGap = false
+		if c.props.PlaybackStatus != models.PlaybackStatusPlaying {
+			continue
+		}
+		if c.lyrics != nil {
+			c.update(p, c.currentPosition())
+		} else if c.showTitle && c.props.Metadata.Title != "" {
+			p.Send(utils.FormatTrack(&c.props.Metadata))
+		}
+	}
+	c.notify()
+	c.reschedule()
 }
 
 func (c *Controller) process(props models.MPRISProperties) {
@@ -381,6 +971,8 @@ func (c *Controller) process(props models.MPRISProperties) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	defer func() { c.props = props }()
+	// Freeze the position at the previous playback status
+	c.reanchor(c.currentPosition())
 
 	if props.PlaybackStatus == models.PlaybackStatusUnknown && props.Metadata.Title == "" {
 		slog.Info("backend reset")
@@ -397,41 +989,23 @@ func (c *Controller) process(props models.MPRISProperties) {
 		}
 		trackStr := utils.FormatTrack(&props.Metadata)
 		slog.Info("playback changed", "track", trackStr)
-		if c.showTitle && props.Metadata.Title != "" {
+		if c.showTitle && props.Metadata.Title != "" && !c.paused {
 			for _, p := range c.publishers {
 				p.Send(trackStr)
 			}
 		}
-		c.currentRequestID++
-		currentReqID := c.currentRequestID
-		go func() {
-			lyrics, shouldCache := c.fetchLyrics(&props.Metadata, currentReqID)
-			if c.cache != nil && lyrics != nil && shouldCache {
-				slog.Info("set cache", "track", trackStr, "source", lyrics.Source)
-				go c.cache.Set(&props.Metadata, lyrics)
-			}
-			c.mu.Lock()
-			defer c.mu.Unlock()
-			if currentReqID != c.currentRequestID {
-				slog.Info("request discarded", "track", trackStr)
-				return
-			}
-			if lyrics == nil {
-				slog.Info("no lyrics available", "track", trackStr)
-				return
-			}
-			slog.Info("got lyrics", "track", trackStr, "source", lyrics.Source)
-			c.setLyrics(lyrics)
-			if c.props.PlaybackStatus == models.PlaybackStatusPlaying {
-				go c.timedSend()
-			}
-		}()
+		c.fetch(props.Metadata)
 	} else if props.PlaybackStatus != c.props.PlaybackStatus {
 		if props.PlaybackStatus == models.PlaybackStatusPlaying {
 			slog.Info("playback started")
 			for _, p := range c.publishers {
-				if c.lyrics != nil && c.lyrics.IndexOf(c.position, p.Offset) != -1 {
-					p.Send(c.lyrics.Get(p.SentIndex))
+				if c.paused {
+					continue
+				}
+				if c.lyrics != nil && p.SentGap {
+					p.SendGap()
+				} else if c.lyrics != nil && c.lyricsFor(p).IndexOf(c.position, p.Offset) != -1 {
+					p.SendLine(c.lyricsFor(p), p.SentIndex, p.SentWordIndex)
 				} else if c.showTitle && props.Metadata.Title != "" {
 					p.Send(utils.FormatTrack(&props.Metadata))
 				}
@@ -439,18 +1013,82 @@ func (c *Controller) process(props models.MPRISProperties) {
 			go c.timedSend()
 		} else {
 			slog.Info("playback stopped")
-			if c.cancelTicking != nil {
-				c.cancelTicking()
-				c.cancelTicking = nil
+			if c.cancelSending != nil {
+				c.cancelSending()
+				c.cancelSending = nil
 			}
 			for _, p := range c.publishers {
 				p.Clear()
 			}
 		}
 	}
-	if props.Position != c.props.Position {
-		c.position = props.Position
+	if props.Position != c.props.Position && max(props.Position-c.position, c.position-props.Position) > driftTolerance {
+		c.reanchor(props.Position)
+		if c.lyrics != nil {
+			c.trackLine(props.Position)
+		}
+		c.reschedule()
+	} else if props.PlaybackRate() != c.props.PlaybackRate() {
+		slog.Info("playback rate changed", "rate", props.PlaybackRate())
+		c.reschedule()
+	}
+}
+
+// notify tells the subscriber of Changes that the status changed
+func (c *Controller) notify() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Changes is signaled when the track, the lyrics, the current line, the
+// offsets, the paused state or the provider health change, changes in a row
+// are coalesced
+func (c *Controller) Changes() <-chan struct{} {
+	return c.changed
+}
+
+type PublisherStatus struct {
+	ID     string
+	Offset int
+}
+
+type ControllerStatus struct {
+	Track      models.MPRISMetadata
+	Lyrics     *models.Lyrics // Nil if there are none
+	Line       int            // Current line without publisher offsets, -1 before the first one
+	Publishers []PublisherStatus
+	Paused     bool
+	Providers  []ProviderHealth
+}
+
+func (c *Controller) Status() ControllerStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := ControllerStatus{
+		Track:      c.props.Metadata.Clone(),
+		Lyrics:     c.lyrics,
+		Line:       -1,
+		Publishers: make([]PublisherStatus, len(c.publishers)),
+		Paused:     c.paused,
+		Providers:  c.ProviderHealth(),
+	}
+	if c.lyrics != nil {
+		status.Line = c.lyrics.IndexOf(c.currentPosition(), 0)
+	}
+	for i, p := range c.publishers {
+		status.Publishers[i] = PublisherStatus{ID: p.ID(), Offset: p.Offset}
+	}
+	return status
+}
+
+func (c *Controller) ProviderHealth() []ProviderHealth {
+	health := make([]ProviderHealth, len(c.providers))
+	for i, p := range c.providers {
+		health[i] = p.Health()
 	}
+	return health
 }
 
 func (c *Controller) Serve() {
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"slices"
+	"testing"
+	"time"
+
+	"lrcd/models"
+	"lrcd/providers"
+
+	"github.com/godbus/dbus/v5"
+)
+
+type recordingPublisher struct {
+	sent chan string
+}
+
+func (*recordingPublisher) ID() string {
+	return "test"
+}
+
+func (p *recordingPublisher) Send(txt string) error {
+	p.sent <- txt
+	return nil
+}
+
+func (*recordingPublisher) Exit() error {
+	return nil
+}
+
+func TestNextChange(t *testing.T) {
+	pub := &recordingPublisher{sent: make(chan string, 16)}
+	p := NewPublisherEntry(pub, &PublisherEntryOptions{Offset: -200, Karaoke: true, ClearAfter: 3000})
+	c := &Controller{
+		publishers: []*PublisherEntry{p},
+		lyrics: &models.Lyrics{Lines: []*models.LyricLine{
+			{Position: 1000, End: 2000, Text: "Hello world", Words: []*models.LyricWord{{Position: 1000, Text: "Hello "}, {Position: 1500, Text: "world"}}},
+			{Position: 10000, Text: "next"},
+		}},
+	}
+	// Nothing changes before the first line
+	c.update(p, 0)
+	if delay := c.nextChange(p, 0); delay != 801 {
+		t.Errorf("expected delay 801, got %d", delay)
+	}
+	// Position, expected delay and sent text, lines show up 200ms early
+	steps := []struct {
+		position int
+		delay    int
+		sent     string
+	}{
+		{801, 500, "Hello " + US + "world"},
+		{1301, 3499, "Hello world" + US},
+		{4800, 5001, ""},
+		{9801, 4499, "next"},
+	}
+	for _, step := range steps {
+		c.update(p, step.position)
+		if got := <-pub.sent; got != step.sent {
+			t.Errorf("at %d: expected %q, got %q", step.position, step.sent, got)
+		}
+		if delay := c.nextChange(p, step.position); delay != step.delay {
+			t.Errorf("at %d: expected delay %d, got %d", step.position, step.delay, delay)
+		}
+	}
+}
+
+func TestCurrentPositionRate(t *testing.T) {
+	c := &Controller{props: models.MPRISProperties{PlaybackStatus: models.PlaybackStatusPlaying, Rate: 1.25}}
+	c.reanchor(10000)
+	c.anchor = c.anchor.Add(-2 * time.Second)
+	if position := c.currentPosition(); position < 12500 || position > 12600 {
+		t.Errorf("expected position around 12500, got %d", position)
+	}
+	c.props.Rate = 0
+	if position := c.currentPosition(); position < 12000 || position > 12100 {
+		t.Errorf("unknown rate should be 1, got position %d", position)
+	}
+	c.props.PlaybackStatus = models.PlaybackStatusPaused
+	if position := c.currentPosition(); position != 10000 {
+		t.Errorf("paused position moved to %d", position)
+	}
+}
+
+func TestControllerStatus(t *testing.T) {
+	pub := &recordingPublisher{sent: make(chan string, 16)}
+	prov := NewProviderEntry(&stubProvider{id: "down"})
+	for range breakerThreshold {
+		prov.report(providers.ErrNetworkFailure, 100*time.Millisecond)
+	}
+	c := NewController(&ControllerOptions{
+		providers:  []*ProviderEntry{prov},
+		publishers: []*PublisherEntry{NewPublisherEntry(pub, &PublisherEntryOptions{})},
+	})
+	c.props = models.MPRISProperties{Metadata: models.MPRISMetadata{Title: "Hello"}, PlaybackStatus: models.PlaybackStatusPlaying}
+	c.setLyrics(&models.Lyrics{Lines: []*models.LyricLine{{Position: 0, Text: "one"}, {Position: 1000, Text: "two"}}})
+	c.reanchor(1500)
+
+	if err := c.SetOffset("missing", 100); !errors.Is(err, ErrUnknownPublisher) {
+		t.Errorf("expected ErrUnknownPublisher, got %v", err)
+	}
+	if err := c.SetOffset("test", -200); err != nil {
+		t.Fatal(err)
+	}
+	c.Pause()
+	if got := <-pub.sent; got != ETX {
+		t.Errorf("expected publishers to be cleared, got %q", got)
+	}
+	status := c.Status()
+	if status.Line != 1 || !status.Paused || status.Publishers[0].Offset != -200 {
+		t.Errorf("unexpected status %+v", status)
+	}
+	props := statusProperties(status)
+	if props["Line"] != "two" || props["NextLine"] != "" || props["Track"].(map[string]dbus.Variant)["title"].Value() != "Hello" {
+		t.Errorf("unexpected properties %v", props)
+	}
+	if health := props["Providers"].([]serviceProvider); health[0].State != "open" || health[0].Failures != breakerThreshold || health[0].OpenUntil <= time.Now().UnixMilli() {
+		t.Errorf("unexpected provider health %+v", health)
+	}
+	c.Resume()
+	if got := <-pub.sent; got != "two" {
+		t.Errorf("expected the current line on resume, got %q", got)
+	}
+	select {
+	case <-c.Changes():
+	default:
+		t.Error("expected a change notification")
+	}
+}
+
+func TestPlainModePerPublisher(t *testing.T) {
+	estimate := NewPublisherEntry(&recordingPublisher{sent: make(chan string, 16)}, &PublisherEntryOptions{})
+	block := NewPublisherEntry(&recordingPublisher{sent: make(chan string, 16)}, &PublisherEntryOptions{Plain: PlainModeBlock})
+	c := NewController(&ControllerOptions{publishers: []*PublisherEntry{estimate, block}})
+	c.props = models.MPRISProperties{Metadata: models.MPRISMetadata{Title: "Hello", Duration: time.Minute}}
+	c.setLyrics(&models.Lyrics{Unsynced: true, Lines: []*models.LyricLine{{Text: "one"}, {Text: "two"}}})
+
+	if lyrics := c.lyricsFor(estimate); lyrics.Len() != 2 || lyrics.Lines[1].Position == 0 {
+		t.Errorf("expected estimated timing, got %+v", lyrics.Lines)
+	}
+	if lyrics := c.lyricsFor(block); lyrics.Len() != 1 || lyrics.Get(0) != "one\ntwo" {
+		t.Errorf("expected a single block, got %+v", lyrics.Lines)
+	}
+	// Synced lyrics are the same for everyone
+	c.setLyrics(&models.Lyrics{Lines: []*models.LyricLine{{Position: 1000, Text: "one"}}})
+	if c.lyricsFor(block) != c.lyrics {
+		t.Error("block mode should not apply to synced lyrics")
+	}
+}
+
+// Lazy stubs only search when iterated, like lrclib, and report err from there
+type stubProvider struct {
+	id         string
+	candidates []*models.Candidate
+	err        error
+	lazy       bool
+}
+
+func (p *stubProvider) ID() string {
+	return cmp.Or(p.id, "test")
+}
+
+func (p *stubProvider) IterAll(ctx context.Context, _ *models.MPRISMetadata) (iter.Seq[*models.Candidate], error) {
+	if !p.lazy {
+		if p.err != nil {
+			return nil, p.err
+		}
+		return slices.Values(p.candidates), nil
+	}
+	return func(yield func(*models.Candidate) bool) {
+		if p.err != nil {
+			providers.ReportFailure(ctx, p.err)
+			return
+		}
+		for _, candidate := range p.candidates {
+			if !yield(candidate) {
+				return
+			}
+		}
+	}, nil
+}
+
+func stubCandidate(id string, duration time.Duration, lyrics *models.Lyrics) *models.Candidate {
+	return &models.Candidate{
+		ID:       id,
+		Titles:   []string{"Hello"},
+		Artists:  []string{"World"},
+		Duration: duration,
+		Lyrics:   func(context.Context) (*models.Lyrics, error) { return lyrics, nil },
+	}
+}
+
+func TestFetchBestRanksAcrossProviders(t *testing.T) {
+	meta := &models.MPRISMetadata{Title: "Hello", Artists: []string{"World"}, Duration: 3 * time.Minute}
+	lines := &models.Lyrics{Source: "lines", Lines: []*models.LyricLine{{Position: 1000, Text: "Hello"}, {Position: 2000, Text: "world"}}}
+	words := &models.Lyrics{Source: "words", Lines: []*models.LyricLine{
+		{Position: 1000, Text: "Hello", Words: []*models.LyricWord{{Position: 1000, Text: "Hel"}, {Position: 1250, Text: "lo"}}},
+		{Position: 2000, Text: "world", Words: []*models.LyricWord{{Position: 2000, Text: "world"}}},
+	}}
+	plain := &models.Lyrics{Source: "plain", Unsynced: true, Lines: []*models.LyricLine{{Text: "Hello"}, {Text: "world"}}}
+	// The word timed candidate is a slightly worse match, within the tie margin
+	offDuration := meta.Duration + 2*time.Second
+	query := newTrackQuery(meta)
+	exact := query.Score(stubCandidate("", meta.Duration, nil), "test")
+	off := query.Score(stubCandidate("", offDuration, nil), "test")
+	if off >= exact || off < exact-rankTieMargin {
+		t.Fatalf("unexpected scores %f and %f", exact, off)
+	}
+
+	c := NewController(&ControllerOptions{
+		providers: []*ProviderEntry{
+			NewProviderEntry(&stubProvider{id: "a", candidates: []*models.Candidate{stubCandidate("1", meta.Duration, lines)}}),
+			NewProviderEntry(&stubProvider{id: "b", candidates: []*models.Candidate{stubCandidate("2", offDuration, words)}}),
+			NewProviderEntry(&stubProvider{id: "c", candidates: []*models.Candidate{stubCandidate("3", meta.Duration, plain)}}),
+		},
+		fetchMode:      FetchModeBest,
+		matchThreshold: DefaultMatchThreshold,
+		plainLyrics:    true,
+	})
+	lyrics, conclusive := c.fetchBest(context.Background(), meta)
+	if !conclusive || lyrics == nil || lyrics.Source != "words" {
+		t.Fatalf("expected the word timed lyrics, got %+v", lyrics)
+	}
+}
+
+func TestFetchFailureNotCached(t *testing.T) {
+	meta := &models.MPRISMetadata{Title: "Hello", Artists: []string{"World"}}
+	for _, mode := range []FetchMode{FetchModeFallback, FetchModeFastest, FetchModeBest} {
+		prov := &stubProvider{err: fmt.Errorf("%w: 503 Service Unavailable", providers.ErrNetworkFailure), lazy: true}
+		c := NewController(&ControllerOptions{
+			providers:      []*ProviderEntry{NewProviderEntry(prov)},
+			fetchMode:      mode,
+			matchThreshold: DefaultMatchThreshold,
+			cacheDir:       t.TempDir(),
+		})
+		lyrics, shouldCache := c.fetchLyrics(meta, c.currentRequestID)
+		if lyrics != nil || shouldCache {
+			t.Errorf("mode %d: failed search would be cached as a miss", mode)
+		}
+		// A search that succeeds without a match is a real miss
+		prov.err = nil
+		lyrics, shouldCache = c.fetchLyrics(meta, c.currentRequestID)
+		if lyrics != nil || !shouldCache {
+			t.Errorf("mode %d: expected a cacheable miss", mode)
+		}
+	}
+}
+
+func TestPlainLyricsCached(t *testing.T) {
+	meta := &models.MPRISMetadata{Title: "Hello", Artists: []string{"World"}, Duration: 3 * time.Minute}
+	plain := &models.Lyrics{Source: "plain", Unsynced: true, Lines: []*models.LyricLine{{Text: "Hello"}, {Text: "world"}}}
+	dir := t.TempDir()
+	opt := &ControllerOptions{
+		providers:      []*ProviderEntry{NewProviderEntry(&stubProvider{id: "plain", candidates: []*models.Candidate{stubCandidate("1", meta.Duration, plain)}})},
+		matchThreshold: DefaultMatchThreshold,
+		cacheDir:       dir,
+	}
+	c := NewController(opt)
+	// Plain lyrics are cached even when disabled, instead of a miss
+	lyrics, shouldCache := c.fetchLyrics(meta, c.currentRequestID)
+	if lyrics == nil || !lyrics.Unsynced || !shouldCache {
+		t.Fatalf("expected cacheable plain lyrics, got %+v", lyrics)
+	}
+	err := c.cache.Set(meta, lyrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lyrics, _ = c.fetchLyrics(meta, c.currentRequestID)
+	if lyrics == nil || lyrics.Len() != 0 {
+		t.Errorf("expected disabled plain lyrics to read as a miss, got %+v", lyrics)
+	}
+	opt.plainLyrics = true
+	c = NewController(opt)
+	lyrics, _ = c.fetchLyrics(meta, c.currentRequestID)
+	if lyrics == nil || lyrics.Len() != 2 {
+		t.Errorf("expected plain lyrics from the cache, got %+v", lyrics)
+	}
+}
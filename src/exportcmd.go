@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"lrcd/models"
+	"lrcd/utils"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const exportUsage = `usage: lrcd export [-format lrc|elrc|srt|json] [-track pattern] <file>
+
+Write the lyrics lrcd is showing for the current track, or those of the cached
+track matching the pattern, to the file, or to stdout if the file is "-".
+
+The format defaults to the file extension, or to enhanced LRC (elrc), which
+keeps word timing and translations.`
+
+var ErrUnknownFormat = errors.New("unknown format")
+
+var exportFormats = []string{"lrc", "elrc", "srt", "json"}
+
+// formatLyrics serializes the lyrics, unsynced lyrics get estimated timing for
+// formats that require it
+func formatLyrics(lyrics *models.Lyrics, track *models.MPRISMetadata, format string) ([]byte, error) {
+	switch format {
+	case "lrc":
+		return []byte(lyrics.LRC(track)), nil
+	case "elrc":
+		return []byte(lyrics.EnhancedLRC(track)), nil
+	case "srt":
+		if lyrics.Unsynced {
+			lyrics = lyrics.EstimateTiming(track.Duration)
+		}
+		return []byte(lyrics.SRT()), nil
+	case "json":
+		return lyrics.JSON(track)
+	}
+	return nil, fmt.Errorf("%w %q, expected lrc, elrc, srt or json", ErrUnknownFormat, format)
+}
+
+func runExportCommand(cacheDir string, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(flags.Output(), exportUsage) }
+	format := flags.String("format", "", "lrc, elrc, srt or json")
+	pattern := flags.String("track", "", "export the cached track matching the pattern")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New(exportUsage)
+	}
+	dst := flags.Arg(0)
+	if *format == "" {
+		*format = "elrc"
+		if ext := strings.TrimPrefix(filepath.Ext(dst), "."); slices.Contains(exportFormats, ext) {
+			*format = ext
+		}
+	}
+
+	var data []byte
+	var summary string
+	if *pattern != "" {
+		cache := &Cache{path: cacheDir}
+		entry, err := findEntry(cache, *pattern)
+		if err != nil {
+			return err
+		}
+		lyrics, track, err := cache.ReadEntry(entry.Name)
+		if err != nil {
+			return err
+		}
+		if lyrics.Len() == 0 {
+			return fmt.Errorf("no lyrics for %s", utils.FormatTrack(track))
+		}
+		data, err = formatLyrics(lyrics, track, *format)
+		if err != nil {
+			return err
+		}
+		summary = fmt.Sprintf("%d lines of %s", lyrics.Len(), utils.FormatTrack(track))
+	} else {
+		data, err = currentLyrics(*format)
+		if err != nil {
+			return err
+		}
+		summary = "current lyrics"
+	}
+	if dst == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	err = os.WriteFile(dst, data, 0o644)
+	if err != nil {
+		return err
+	}
+	fmt.Println("exported", summary)
+	return nil
+}
+
+// currentLyrics asks the running daemon for the lyrics it is showing, which
+// may come from providers whose results are never cached
+func currentLyrics(format string) ([]byte, error) {
+	if !slices.Contains(exportFormats, format) {
+		return nil, fmt.Errorf("%w %q, expected lrc, elrc, srt or json", ErrUnknownFormat, format)
+	}
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to session bus: %w", err)
+	}
+	defer conn.Close()
+	var data string
+	err = daemonError(conn.Object(busName, busPath).Call(busInterface+".Export", 0, format).Store(&data))
+	if errors.Is(err, ErrNotRunning) {
+		return nil, fmt.Errorf("%w, use -track to export cached lyrics", err)
+	} else if err != nil {
+		return nil, err
+	}
+	return []byte(data), nil
+}
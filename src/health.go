@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"log/slog"
+	"sync"
+	"time"
+
+	"lrcd/models"
+	"lrcd/providers"
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+const (
+	breakerThreshold   = 3 // Consecutive failures before the circuit opens
+	breakerCooldown    = 30 * time.Second
+	breakerMaxCooldown = 10 * time.Minute
+)
+
+type ProviderHealth struct {
+	ID         string
+	State      BreakerState
+	Failures   int // Consecutive
+	Requests   int
+	Errors     int
+	RateLimits int
+	Latency    time.Duration // Moving average
+	OpenUntil  time.Time
+}
+
+type ProviderEntry struct {
+	providers.Provider
+
+	mu       sync.Mutex
+	health   ProviderHealth
+	cooldown time.Duration
+	probing  bool
+}
+
+func NewProviderEntry(provider providers.Provider) *ProviderEntry {
+	return &ProviderEntry{
+		Provider: provider,
+		health:   ProviderHealth{ID: provider.ID()},
+		cooldown: breakerCooldown,
+	}
+}
+
+// Allow reports whether the provider should be queried, an open circuit lets
+// a single probe through once the cooldown has passed
+func (p *ProviderEntry) Allow() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch p.health.State {
+	case BreakerOpen:
+		if time.Now().Before(p.health.OpenUntil) {
+			return false
+		}
+		slog.Info("provider circuit half-open", "source", p.ID())
+		p.health.State = BreakerHalfOpen
+		p.probing = true
+		return true
+	case BreakerHalfOpen:
+		if p.probing {
+			return false
+		}
+		p.probing = true
+	}
+	return true
+}
+
+func (p *ProviderEntry) report(err error, latency time.Duration) {
+	// Canceled requests say nothing about the provider
+	if errors.Is(err, context.Canceled) {
+		p.mu.Lock()
+		p.probing = false
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h := &p.health
+	h.Requests++
+	if h.Latency == 0 {
+		h.Latency = latency
+	} else {
+		h.Latency = (h.Latency*4 + latency) / 5
+	}
+	p.probing = false
+	failed := errors.Is(err, providers.ErrNetworkFailure) || errors.Is(err, providers.ErrRateLimit) || errors.Is(err, context.DeadlineExceeded)
+	if !failed {
+		if h.State != BreakerClosed {
+			slog.Info("provider circuit closed", "source", p.ID(), "latency", latency, "requests", h.Requests, "errors", h.Errors)
+		}
+		h.State = BreakerClosed
+		h.Failures = 0
+		p.cooldown = breakerCooldown
+		slog.Debug("provider request", "source", p.ID(), "latency", latency)
+		return
+	}
+	h.Errors++
+	h.Failures++
+	rateLimited := errors.Is(err, providers.ErrRateLimit)
+	if rateLimited {
+		h.RateLimits++
+	}
+	slog.Debug("provider request failed", "source", p.ID(), "error", err, "latency", latency, "failures", h.Failures)
+	if h.State == BreakerOpen || (h.State == BreakerClosed && h.Failures < breakerThreshold && !rateLimited) {
+		return
+	}
+	if h.State == BreakerHalfOpen {
+		p.cooldown = min(p.cooldown*2, breakerMaxCooldown)
+	}
+	h.State = BreakerOpen
+	h.OpenUntil = time.Now().Add(p.cooldown)
+	slog.Warn("provider circuit opened", "source", p.ID(), "error", err, "failures", h.Failures, "cooldown", p.cooldown)
+}
+
+func (p *ProviderEntry) Health() ProviderHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.health
+}
+
+// IterAll wraps the provider to track the outcome of every request. Providers
+// searching lazily report failures while they are iterated, so the search is
+// recorded once the iteration ends, timing only the provider's own work.
+func (p *ProviderEntry) IterAll(ctx context.Context, meta *models.MPRISMetadata) (iter.Seq[*models.Candidate], error) {
+	var failure error
+	ctx = providers.WithFailures(ctx, func(err error) {
+		if failure == nil {
+			failure = err
+		}
+	})
+	start := time.Now()
+	seq, err := p.Provider.IterAll(ctx, meta)
+	elapsed := time.Since(start)
+	if err != nil {
+		p.report(err, elapsed)
+		return nil, err
+	}
+	return func(yield func(*models.Candidate) bool) {
+		mark := time.Now()
+		defer func() {
+			p.report(failure, elapsed+time.Since(mark))
+		}()
+		for candidate := range seq {
+			elapsed += time.Since(mark)
+			wrapped := *candidate
+			wrapped.Lyrics = func(ctx context.Context) (*models.Lyrics, error) {
+				start := time.Now()
+				lyrics, err := candidate.Lyrics(ctx)
+				p.report(err, time.Since(start))
+				return lyrics, err
+			}
+			ok := yield(&wrapped)
+			mark = time.Now()
+			if !ok {
+				return
+			}
+		}
+	}, nil
+}
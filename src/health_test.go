@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"lrcd/models"
+	"lrcd/providers"
+)
+
+func TestProviderBreaker(t *testing.T) {
+	prov := &stubProvider{err: providers.ErrNetworkFailure}
+	entry := NewProviderEntry(prov)
+	for range breakerThreshold {
+		if !entry.Allow() {
+			t.Fatal("expected closed circuit")
+		}
+		entry.IterAll(context.Background(), &models.MPRISMetadata{})
+	}
+	if entry.Allow() {
+		t.Fatal("expected open circuit")
+	}
+
+	entry.mu.Lock()
+	entry.health.OpenUntil = time.Now()
+	entry.mu.Unlock()
+	if !entry.Allow() {
+		t.Fatal("expected half-open probe")
+	}
+	if entry.Allow() {
+		t.Fatal("expected a single probe")
+	}
+	prov.err = nil
+	seq, _ := entry.IterAll(context.Background(), &models.MPRISMetadata{})
+	// The search is recorded once the candidates have been iterated
+	for range seq {
+	}
+	if h := entry.Health(); h.State != BreakerClosed || h.Failures != 0 {
+		t.Fatalf("unexpected health %+v", h)
+	}
+}
+
+func TestProviderBreakerLazy(t *testing.T) {
+	prov := &stubProvider{err: providers.ErrNetworkFailure, lazy: true}
+	entry := NewProviderEntry(prov)
+	for i := range breakerThreshold {
+		if !entry.Allow() {
+			t.Fatal("expected closed circuit")
+		}
+		seq, err := entry.IterAll(context.Background(), &models.MPRISMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := entry.Health(); h.Requests != i {
+			t.Fatal("search recorded before it ran")
+		}
+		for range seq {
+		}
+	}
+	if entry.Allow() {
+		t.Fatalf("expected open circuit, got %+v", entry.Health())
+	}
+
+	entry.mu.Lock()
+	entry.health.OpenUntil = time.Now()
+	entry.mu.Unlock()
+	if !entry.Allow() {
+		t.Fatal("expected half-open probe")
+	}
+	prov.err = nil
+	seq, _ := entry.IterAll(context.Background(), &models.MPRISMetadata{})
+	if h := entry.Health(); h.State != BreakerHalfOpen {
+		t.Fatalf("probe closed the circuit before searching: %+v", h)
+	}
+	for range seq {
+		break
+	}
+	if h := entry.Health(); h.State != BreakerClosed || h.Requests != breakerThreshold+1 {
+		t.Fatalf("unexpected health %+v", h)
+	}
+}
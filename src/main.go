@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"log/slog"
 	"os"
@@ -13,17 +15,76 @@ import (
 	"github.com/godbus/dbus/v5"
 )
 
+func userCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "lrcd"), nil
+}
+
+func userConfigDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "lrcd"), nil
+}
+
+func runCommand(cmd string, args []string) error {
+	switch cmd {
+	case "cache":
+		dir, err := userCacheDir()
+		if err != nil {
+			return fmt.Errorf("failed to get user cache directory: %w", err)
+		}
+		return runCacheCommand(dir, args)
+	case "override":
+		dir, err := userConfigDir()
+		if err != nil {
+			return fmt.Errorf("failed to get user config directory: %w", err)
+		}
+		// Without a config, any player may be picked
+		selector, err := ParsePlayers(filepath.Join(dir, "config.yaml"))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to parse config: %w", err)
+		}
+		return runOverrideCommand(filepath.Join(dir, "overrides"), selector, args)
+	case "export":
+		dir, err := userCacheDir()
+		if err != nil {
+			return fmt.Errorf("failed to get user cache directory: %w", err)
+		}
+		return runExportCommand(dir, args)
+	case "players":
+		return runPlayersCommand(args)
+	}
+	return fmt.Errorf("unknown command %q, expected cache, export, override or players", cmd)
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		err := runCommand(os.Args[1], os.Args[2:])
+		if err != nil {
+			log.SetFlags(0)
+			log.Fatal(err)
+		}
+		return
+	}
+
 	conn, err := dbus.ConnectSessionBus()
 	if err != nil {
 		log.Fatal("failed to connect to session bus:", err)
 	}
+	err = RequestName(conn)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	userConfigDir, err := os.UserConfigDir()
+	configDir, err := userConfigDir()
 	if err != nil {
 		log.Fatal("failed to get user config directory:", err)
 	}
-	configDir := filepath.Join(userConfigDir, "lrcd")
 	err = os.MkdirAll(configDir, 0o755)
 	if err != nil {
 		log.Fatal("failed to create config directory:", err)
@@ -35,11 +96,10 @@ func main() {
 	}
 	cacheDir := ""
 	if config.UseCache {
-		userCacheDir, err := os.UserCacheDir()
+		cacheDir, err = userCacheDir()
 		if err != nil {
 			log.Fatal("failed to get user cache directory:", err)
 		}
-		cacheDir = filepath.Join(userCacheDir, "lrcd")
 		err = os.MkdirAll(cacheDir, 0o755)
 		if err != nil {
 			log.Fatal("failed to create cache directory:", err)
@@ -50,19 +110,53 @@ func main() {
 
 	propsCh := make(chan models.MPRISProperties, 8)
 	controller := NewController(&ControllerOptions{
-		providers:    config.Providers,
-		publishers:   config.Publishers,
-		fetchMode:    config.FetchMode,
-		fetchTimeout: config.FetchTimeout,
-		showTitle:    config.ShowTitle,
-		filters:      config.Filters,
-		urlBlacklist: config.URLBlacklist,
-		propsCh:      propsCh,
-		cacheDir:     cacheDir,
+		providers:      config.Providers,
+		publishers:     config.Publishers,
+		fetchMode:      config.FetchMode,
+		fetchTimeout:   config.FetchTimeout,
+		matchThreshold: config.MatchThreshold,
+		showTitle:      config.ShowTitle,
+		plainLyrics:    config.PlainLyrics,
+		filters:        config.Filters,
+		urlBlacklist:   config.URLBlacklist,
+		propsCh:        propsCh,
+		cacheDir:       cacheDir,
+		overridesDir:   filepath.Join(configDir, "overrides"),
+		missTTL:        config.MissTTL,
+		cacheTTL:       config.CacheTTL,
+		cacheEntries:   config.CacheEntries,
+		cacheBytes:     config.CacheSize,
 	})
-	mpris := NewMPRIS(propsCh, conn)
+	mpris := NewMPRIS(propsCh, conn, config.Players)
 	go mpris.Serve()
 	go controller.Serve()
+	service, err := NewService(conn, controller, mpris)
+	if err != nil {
+		slog.Error("failed to export service", "error", err)
+	} else {
+		go service.Serve()
+	}
+
+	// SIGUSR1 forces the current track to be fetched again, bypassing the cache
+	rCh := make(chan os.Signal, 1)
+	signal.Notify(rCh, syscall.SIGUSR1)
+	go func() {
+		for range rCh {
+			controller.Refetch()
+		}
+	}()
+
+	// SIGUSR2 blacklists the lyrics of the current track and fetches them again
+	bCh := make(chan os.Signal, 1)
+	signal.Notify(bCh, syscall.SIGUSR2)
+	go func() {
+		for range bCh {
+			err := controller.Blacklist()
+			if err != nil {
+				slog.Info("blacklist skipped", "error", err)
+			}
+		}
+	}()
 
 	sCh := make(chan os.Signal, 1)
 	signal.Notify(sCh, syscall.SIGINT, syscall.SIGTERM)
@@ -0,0 +1,169 @@
+package models
+
+import (
+	"encoding/json/jsontext"
+	"encoding/json/v2"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Format milliseconds as mm:ss.xxx, which the LRC parser reads back losslessly
+func formatLRCPosition(position int) string {
+	position = max(position, 0)
+	return fmt.Sprintf("%02d:%02d.%03d", position/60_000, position/1000%60, position%1000)
+}
+
+func formatSRTPosition(position int) string {
+	position = max(position, 0)
+	return fmt.Sprintf("%02d:%02d:%02d,%03d", position/3_600_000, position/60_000%60, position/1000%60, position%1000)
+}
+
+// Write the track and the source as ID tags, one [ar:] per artist
+func (l *Lyrics) writeTags(builder *strings.Builder, track *MPRISMetadata) {
+	if track != nil {
+		if track.Title != "" {
+			fmt.Fprintf(builder, "[ti:%s]\n", track.Title)
+		}
+		for _, artist := range track.Artists {
+			fmt.Fprintf(builder, "[ar:%s]\n", artist)
+		}
+		if track.Album != "" {
+			fmt.Fprintf(builder, "[al:%s]\n", track.Album)
+		}
+		if track.Duration > 0 {
+			fmt.Fprintf(builder, "[length:%s]\n", formatLRCPosition(int(track.Duration.Milliseconds())))
+		}
+	}
+	if l.Source != "" {
+		fmt.Fprintf(builder, "[source:%s]\n", l.Source)
+	}
+}
+
+func (l *Lyrics) formatLRC(track *MPRISMetadata, enhanced bool) string {
+	builder := &strings.Builder{}
+	l.writeTags(builder, track)
+	for _, line := range l.Lines {
+		// Plain lyrics are written without timestamps, to be read back as such
+		if l.Unsynced {
+			builder.WriteString(line.Text + "\n")
+			continue
+		}
+		stamp := "[" + formatLRCPosition(line.Position) + "]"
+		builder.WriteString(stamp)
+		if !enhanced || len(line.Words) == 0 {
+			builder.WriteString(line.Text)
+		} else {
+			for _, word := range line.Words {
+				builder.WriteString("<" + formatLRCPosition(word.Position) + ">" + word.Text)
+			}
+			if line.End > line.Position {
+				builder.WriteString("<" + formatLRCPosition(line.End) + ">")
+			}
+		}
+		builder.WriteByte('\n')
+		// Secondary tracks share the timestamp, a romanization without
+		// translation would be read back as one
+		if line.Translation != "" {
+			builder.WriteString(stamp + line.Translation + "\n")
+			if line.Romanization != "" {
+				builder.WriteString(stamp + line.Romanization + "\n")
+			}
+		}
+	}
+	return builder.String()
+}
+
+// LRC writes the lyrics as standard LRC, the track is optional and written as
+// ID tags
+func (l *Lyrics) LRC(track *MPRISMetadata) string {
+	return l.formatLRC(track, false)
+}
+
+// EnhancedLRC is LRC with word timing, and the end of lines with word timing
+// as a trailing word stamp
+func (l *Lyrics) EnhancedLRC(track *MPRISMetadata) string {
+	return l.formatLRC(track, true)
+}
+
+// SRT writes a cue for each non-empty line, lasting until it ends, with the
+// translation on a second line
+func (l *Lyrics) SRT() string {
+	builder := &strings.Builder{}
+	n := 0
+	for i, line := range l.Lines {
+		if line.Text == "" {
+			continue
+		}
+		n++
+		fmt.Fprintf(builder, "%d\n%s --> %s\n%s\n", n, formatSRTPosition(line.Position), formatSRTPosition(l.EndOf(i)), line.Text)
+		if line.Translation != "" {
+			builder.WriteString(line.Translation + "\n")
+		}
+		builder.WriteByte('\n')
+	}
+	return builder.String()
+}
+
+type jsonTrack struct {
+	Title    string   `json:"title"`
+	Artists  []string `json:"artists"`
+	Album    string   `json:"album,omitempty"`
+	Duration int64    `json:"duration,omitzero"` // milli
+}
+
+type jsonWord struct {
+	Start int    `json:"start"` // milli
+	Text  string `json:"text"`
+}
+
+type jsonLine struct {
+	Start        int        `json:"start"` // milli
+	End          int        `json:"end,omitzero"`
+	Text         string     `json:"text"`
+	Translation  string     `json:"translation,omitempty"`
+	Romanization string     `json:"romanization,omitempty"`
+	Words        []jsonWord `json:"words,omitempty"`
+}
+
+type jsonLyrics struct {
+	Track        *jsonTrack `json:"track,omitempty"`
+	Source       string     `json:"source,omitempty"`
+	Instrumental bool       `json:"instrumental,omitzero"`
+	Unsynced     bool       `json:"unsynced,omitzero"`
+	FetchedAt    time.Time  `json:"fetched_at,omitzero"`
+	Lines        []jsonLine `json:"lines"`
+}
+
+// JSON writes the lyrics and the optional track, with times in milliseconds
+func (l *Lyrics) JSON(track *MPRISMetadata) ([]byte, error) {
+	v := jsonLyrics{
+		Source:       l.Source,
+		Instrumental: l.Instrumental,
+		Unsynced:     l.Unsynced,
+		FetchedAt:    l.FetchedAt,
+		Lines:        make([]jsonLine, 0, len(l.Lines)),
+	}
+	if track != nil {
+		v.Track = &jsonTrack{
+			Title:    track.Title,
+			Artists:  track.Artists,
+			Album:    track.Album,
+			Duration: track.Duration.Milliseconds(),
+		}
+	}
+	for _, line := range l.Lines {
+		jl := jsonLine{
+			Start:        line.Position,
+			End:          line.End,
+			Text:         line.Text,
+			Translation:  line.Translation,
+			Romanization: line.Romanization,
+		}
+		for _, word := range line.Words {
+			jl.Words = append(jl.Words, jsonWord{Start: word.Position, Text: word.Text})
+		}
+		v.Lines = append(v.Lines, jl)
+	}
+	return json.Marshal(v, jsontext.WithIndent("  "))
+}
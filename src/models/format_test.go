@@ -0,0 +1,40 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnhancedLRC(t *testing.T) {
+	lyrics := &Lyrics{Lines: []*LyricLine{
+		{Position: 1250, Text: "plain line"},
+		{Position: 65000, Text: "Hello world", Words: []*LyricWord{{Position: 65000, Text: "Hello "}, {Position: 65500, Text: "world"}}},
+	}}
+	want := "[00:01.250]plain line\n[01:05.000]<01:05.000>Hello <01:05.500>world\n"
+	if got := lyrics.EnhancedLRC(nil); got != want {
+		t.Errorf("unexpected enhanced lrc:\n%s", got)
+	}
+}
+
+func TestLyricsExport(t *testing.T) {
+	lyrics := &Lyrics{Source: "test", Lines: []*LyricLine{
+		{Position: 1000, Text: "Hello world", Translation: "你好世界", Words: []*LyricWord{{Position: 1000, Text: "Hello "}, {Position: 1500, Text: "world"}}},
+		{Position: 3000},
+		{Position: 4000, Text: "last"},
+	}}
+	track := &MPRISMetadata{Title: "Title", Artists: []string{"A", "B"}, Duration: 65 * time.Second}
+	if got := lyrics.LRC(track); got != "[ti:Title]\n[ar:A]\n[ar:B]\n[length:01:05.000]\n[source:test]\n[00:01.000]Hello world\n[00:01.000]你好世界\n[00:03.000]\n[00:04.000]last\n" {
+		t.Errorf("unexpected lrc:\n%s", got)
+	}
+	if got := lyrics.SRT(); got != "1\n00:00:01,000 --> 00:00:03,000\nHello world\n你好世界\n\n2\n00:00:04,000 --> 00:00:05,500\nlast\n\n" {
+		t.Errorf("unexpected srt:\n%s", got)
+	}
+	buf, err := lyrics.JSON(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(buf); !strings.Contains(s, `"translation": "你好世界"`) || !strings.Contains(s, `"start": 1500`) || !strings.Contains(s, `"duration": 65000`) {
+		t.Errorf("unexpected json:\n%s", s)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"slices"
 	"sort"
+	"strings"
 	"time"
+	"unicode"
 )
 
 type PlaybackStatus int
@@ -16,14 +18,47 @@ const (
 	PlaybackStatusStopped
 )
 
-type LyricLine struct {
+func (s PlaybackStatus) String() string {
+	switch s {
+	case PlaybackStatusPlaying:
+		return "playing"
+	case PlaybackStatusPaused:
+		return "paused"
+	case PlaybackStatusStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+type LyricWord struct {
 	Position int // milli
 	Text     string
 }
 
+type LyricLine struct {
+	Position     int // milli
+	End          int // milli, zero if unknown
+	Text         string
+	Words        []*LyricWord // Optional, only available for enhanced lyrics
+	Translation  string       // Optional, aligned to the line
+	Romanization string       // Optional, aligned to the line
+}
+
+// Track info of the candidate the lyrics were matched to
+type MatchInfo struct {
+	ID       string // Song ID within the source
+	Title    string
+	Artists  []string
+	Duration time.Duration
+}
+
 type Lyrics struct {
-	Lines  []*LyricLine
-	Source string
+	Lines        []*LyricLine
+	Source       string
+	Instrumental bool // Confirmed by the source to have no lyrics, Lines is empty
+	Unsynced     bool // Plain lyrics without timing, all lines are at position 0
+	Match        *MatchInfo
+	FetchedAt    time.Time
 }
 
 func (l *Lyrics) Len() int {
@@ -42,13 +77,157 @@ func (l *Lyrics) Get(index int) string {
 	return l.Lines[index].Text
 }
 
+func (l *Lyrics) GetTranslation(index int) string {
+	if index < 0 || index >= len(l.Lines) {
+		return ""
+	}
+	return l.Lines[index].Translation
+}
+
+func (l *Lyrics) GetRomanization(index int) string {
+	if index < 0 || index >= len(l.Lines) {
+		return ""
+	}
+	return l.Lines[index].Romanization
+}
+
+// Estimated time to sing a word, or a character of scripts written without
+// spaces, and the slack added to the estimate of a line
+const (
+	unitDuration = 500  // milli
+	lineSlack    = 1000 // milli
+)
+
+func isWide(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul, unicode.Thai)
+}
+
+// Estimate how long a line takes to sing from its word timing or its length
+func estimateDuration(line *LyricLine) int {
+	if len(line.Words) > 0 {
+		return line.Words[len(line.Words)-1].Position - line.Position + unitDuration + lineSlack
+	}
+	units := 0
+	for field := range strings.FieldsSeq(line.Text) {
+		wide := 0
+		for _, r := range field {
+			if isWide(r) {
+				wide++
+			}
+		}
+		units += max(wide, 1)
+	}
+	return units*unitDuration + lineSlack
+}
+
+// EndOf returns when the line ends, empty lines end as soon as they start. Lines
+// without an end time last until the next line, or as long as they are
+// estimated to take when followed by a long gap.
+func (l *Lyrics) EndOf(index int) int {
+	if index < 0 || index >= len(l.Lines) {
+		return 0
+	}
+	line := l.Lines[index]
+	if line.Text == "" {
+		return line.Position
+	}
+	if line.End > line.Position {
+		return line.End
+	}
+	end := line.Position + estimateDuration(line)
+	if index+1 < len(l.Lines) {
+		end = min(end, l.Lines[index+1].Position)
+	}
+	return end
+}
+
+// Part of the track assumed to be intro and outro when spreading plain lyrics
+const plainMargin = 0.1
+
+// EstimateTiming spreads unsynced lines across the track in proportion to
+// their estimated length, or at the estimated pace if the duration is unknown.
+// The result is still flagged as unsynced.
+func (l *Lyrics) EstimateTiming(duration time.Duration) *Lyrics {
+	weights := make([]int, len(l.Lines))
+	total := 0
+	for i, line := range l.Lines {
+		if line.Text == "" {
+			weights[i] = 2 * lineSlack // Stanza break
+		} else {
+			weights[i] = estimateDuration(&LyricLine{Text: line.Text})
+		}
+		total += weights[i]
+	}
+	start := 0.0
+	scale := 1.0
+	if d := float64(duration.Milliseconds()); d > 0 && total > 0 {
+		start = d * plainMargin
+		scale = d * (1 - 2*plainMargin) / float64(total)
+	}
+	estimated := *l
+	estimated.Lines = make([]*LyricLine, len(l.Lines))
+	position := start
+	for i, line := range l.Lines {
+		estimated.Lines[i] = &LyricLine{
+			Position:     int(position),
+			Text:         line.Text,
+			Translation:  line.Translation,
+			Romanization: line.Romanization,
+		}
+		position += float64(weights[i]) * scale
+	}
+	return &estimated
+}
+
+// Block joins unsynced lines into a single line shown until the end of the track
+func (l *Lyrics) Block(duration time.Duration) *Lyrics {
+	texts := make([]string, len(l.Lines))
+	for i, line := range l.Lines {
+		texts[i] = line.Text
+	}
+	block := *l
+	block.Lines = []*LyricLine{{Text: strings.Join(texts, "\n"), End: int(duration.Milliseconds())}}
+	return &block
+}
+
+// WordIndexOf returns -1 if the line has no word timing or no word has started yet
+func (l *Lyrics) WordIndexOf(index int, position int, offset int) int {
+	if index < 0 || index >= len(l.Lines) {
+		return -1
+	}
+	words := l.Lines[index].Words
+	offPos := position - offset
+	return sort.Search(len(words), func(i int) bool { return words[i].Position >= offPos }) - 1
+}
+
+// GetWords splits the line into the part already sung and the part remaining
+func (l *Lyrics) GetWords(index int, wordIndex int) (string, string) {
+	if index < 0 || index >= len(l.Lines) {
+		return "", ""
+	}
+	words := l.Lines[index].Words
+	if wordIndex < 0 || len(words) == 0 {
+		return "", l.Lines[index].Text
+	}
+	sung := &strings.Builder{}
+	rest := &strings.Builder{}
+	for i, w := range words {
+		if i <= wordIndex {
+			sung.WriteString(w.Text)
+		} else {
+			rest.WriteString(w.Text)
+		}
+	}
+	return strings.TrimLeft(sung.String(), " "), strings.TrimRight(rest.String(), " ")
+}
+
 type MPRISMetadata struct {
 	Title    string
 	Artists  []string
 	Text     string
 	URL      string
 	Duration time.Duration
-	// Album    string
+	Album    string
 }
 
 func (m *MPRISMetadata) Clone() MPRISMetadata {
@@ -58,7 +237,7 @@ func (m *MPRISMetadata) Clone() MPRISMetadata {
 		Text:     m.Text,
 		URL:      m.URL,
 		Duration: m.Duration,
-		// Album:    m.Album,
+		Album:    m.Album,
 	}
 }
 
@@ -66,6 +245,15 @@ type MPRISProperties struct {
 	Metadata       MPRISMetadata
 	Position       int
 	PlaybackStatus PlaybackStatus
+	Rate           float64 // Zero if unknown
+}
+
+// PlaybackRate returns the rate the position advances at, 1 if unknown
+func (p *MPRISProperties) PlaybackRate() float64 {
+	if p.Rate <= 0 {
+		return 1
+	}
+	return p.Rate
 }
 
 func (p *MPRISProperties) Clone() MPRISProperties {
@@ -73,12 +261,29 @@ func (p *MPRISProperties) Clone() MPRISProperties {
 		Metadata:       p.Metadata.Clone(),
 		Position:       p.Position,
 		PlaybackStatus: p.PlaybackStatus,
+		Rate:           p.Rate,
 	}
 }
 
 type Candidate struct {
+	ID       string // Song ID within the provider, or path for local files
 	Titles   []string
 	Artists  []string
 	Duration time.Duration
 	Lyrics   func(context.Context) (*Lyrics, error)
 }
+
+func (c *Candidate) Info() *MatchInfo {
+	info := &MatchInfo{
+		ID:       c.ID,
+		Artists:  slices.DeleteFunc(slices.Clone(c.Artists), func(a string) bool { return a == "" }),
+		Duration: c.Duration,
+	}
+	for _, t := range c.Titles {
+		if t != "" {
+			info.Title = t
+			break
+		}
+	}
+	return info
+}
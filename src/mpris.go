@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"log/slog"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -15,27 +17,99 @@ import (
 
 type MPRIS struct {
 	propsCh       chan<- models.MPRISProperties
-	props         models.MPRISProperties
 	mu            sync.Mutex
 	cancelChecker context.CancelFunc
 	conn          *dbus.Conn
 	debouncer     *time.Timer
+	selector      *PlayerSelector
+	players       map[string]*PlayerInfo // Keyed by unique bus name
+	active        string                 // Unique name of the followed player, only its props are sent
+	changed       chan struct{}
 }
 
-func NewMPRIS(propsCh chan<- models.MPRISProperties, conn *dbus.Conn) *MPRIS {
+// PlayerInfo is the state of a player on the bus, only the position of the
+// active player is polled
+type PlayerInfo struct {
+	Name       string // Well-known bus name
+	Identity   string
+	Active     bool
+	Properties models.MPRISProperties
+}
+
+func NewMPRIS(propsCh chan<- models.MPRISProperties, conn *dbus.Conn, selector *PlayerSelector) *MPRIS {
 	return &MPRIS{
-		propsCh: propsCh,
-		conn:    conn,
+		propsCh:  propsCh,
+		conn:     conn,
+		selector: selector,
+		players:  map[string]*PlayerInfo{},
+		changed:  make(chan struct{}, 1),
 	}
 }
 
 func (m *MPRIS) Serve() {
-	go m.startChecker()
-	m.listenSignals()
+	c := make(chan *dbus.Signal, 8)
+	m.conn.Signal(c)
+	m.addMatchSignals()
+	// Players appearing from now on are caught by NameOwnerChanged
+	m.scan()
+	go m.startChecker("")
+	m.listenSignals(c)
+}
+
+// scan loads the state of the players already on the bus
+func (m *MPRIS) scan() {
+	for _, name := range listPlayers(m.conn) {
+		owner := m.nameOwner(name)
+		if owner == "" {
+			continue
+		}
+		m.mu.Lock()
+		m.players[owner] = &PlayerInfo{Name: name}
+		m.mu.Unlock()
+		m.loadPlayer(owner, false)
+	}
+}
+
+// Players returns the state of all players on the bus, sorted by name
+func (m *MPRIS) Players() []PlayerInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	players := make([]PlayerInfo, 0, len(m.players))
+	for owner, player := range m.players {
+		info := *player
+		info.Active = owner == m.active
+		info.Properties = player.Properties.Clone()
+		players = append(players, info)
+	}
+	slices.SortFunc(players, func(a, b PlayerInfo) int { return strings.Compare(a.Name, b.Name) })
+	return players
 }
 
-func (m *MPRIS) listenSignals() {
+// notify tells the subscriber of Changes that the players changed
+func (m *MPRIS) notify() {
+	select {
+	case m.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Changes is signaled when players appear, vanish, change tracks or playback
+// status, or another player is followed. Positions are left out.
+func (m *MPRIS) Changes() <-chan struct{} {
+	return m.changed
+}
+
+func (m *MPRIS) addMatchSignals() {
 	err := m.conn.AddMatchSignal(
+		dbus.WithMatchSender("org.freedesktop.DBus"),
+		dbus.WithMatchInterface("org.freedesktop.DBus"),
+		dbus.WithMatchMember("NameOwnerChanged"),
+		dbus.WithMatchArg0Namespace(strings.TrimSuffix(mprisPrefix, ".")),
+	)
+	if err != nil {
+		log.Fatal("Failed to add match signal:", err)
+	}
+	err = m.conn.AddMatchSignal(
 		dbus.WithMatchPathNamespace("/org/mpris/MediaPlayer2"),
 		dbus.WithMatchInterface("org.freedesktop.DBus.Properties"),
 		dbus.WithMatchMember("PropertiesChanged"),
@@ -51,19 +125,29 @@ func (m *MPRIS) listenSignals() {
 	if err != nil {
 		log.Fatal("Failed to add match signal:", err)
 	}
+}
 
-	c := make(chan *dbus.Signal, 8)
-	m.conn.Signal(c)
+func (m *MPRIS) listenSignals(c <-chan *dbus.Signal) {
 	for signal := range c {
 		m.mu.Lock()
+		var changed bool
 		switch signal.Name {
+		case "org.freedesktop.DBus.NameOwnerChanged":
+			changed = m.onNameOwnerChanged(signal)
 		case "org.freedesktop.DBus.Properties.PropertiesChanged":
-			m.onPropertiesChanged(signal)
+			changed = m.onPropertiesChanged(signal)
 		case "org.mpris.MediaPlayer2.Player.Seeked":
-			m.onSeeked(signal)
+			changed = m.onSeeked(signal)
+		}
+		var props models.MPRISProperties
+		if player, ok := m.players[m.active]; ok {
+			props = player.Properties.Clone()
 		}
-		props := m.props.Clone()
 		m.mu.Unlock()
+		// Signals of other players don't concern the controller
+		if !changed {
+			continue
+		}
 		// Sometimes more than one signal are emitted to fully update metadata (eg. kdeconnect)
 		// So we add a small delay before sending the props we maintain
 		if m.debouncer != nil {
@@ -76,76 +160,259 @@ func (m *MPRIS) listenSignals() {
 	}
 }
 
-func (m *MPRIS) getBackends() []dbus.BusObject {
-	obj := m.conn.Object("org.freedesktop.DBus", "/org/freedesktop/DBus")
+func listPlayers(conn *dbus.Conn) []string {
+	obj := conn.Object("org.freedesktop.DBus", "/org/freedesktop/DBus")
 	var names []string
-	var backends []dbus.BusObject
 	call := obj.Call("org.freedesktop.DBus.ListNames", 0)
 	if call.Err != nil {
-		return []dbus.BusObject{}
+		return nil
 	}
 	call.Store(&names)
-	for _, name := range names {
-		if strings.HasPrefix(name, "org.mpris.MediaPlayer2.") {
-			backends = append(backends, m.conn.Object(name, "/org/mpris/MediaPlayer2"))
+	return slices.DeleteFunc(names, func(name string) bool { return !strings.HasPrefix(name, mprisPrefix) })
+}
+
+func getProperties(obj dbus.BusObject) (models.MPRISProperties, bool) {
+	call := obj.Call(
+		"org.freedesktop.DBus.Properties.GetAll", 0,
+		"org.mpris.MediaPlayer2.Player",
+	)
+	if call.Err != nil || len(call.Body) == 0 {
+		return models.MPRISProperties{}, false
+	}
+	p, ok := call.Body[0].(map[string]dbus.Variant)
+	if !ok {
+		return models.MPRISProperties{}, false
+	}
+	return parseProperties(p), true
+}
+
+func getIdentity(obj dbus.BusObject) string {
+	variant, err := obj.GetProperty("org.mpris.MediaPlayer2.Identity")
+	if err != nil {
+		return ""
+	}
+	identity, _ := variant.Value().(string)
+	return identity
+}
+
+func (m *MPRIS) nameOwner(name string) string {
+	var owner string
+	call := m.conn.BusObject().Call("org.freedesktop.DBus.GetNameOwner", 0, name)
+	if call.Err != nil {
+		return ""
+	}
+	call.Store(&owner)
+	return owner
+}
+
+// loadPlayer queries the state of a player on the bus, and if follow is set
+// switches to it if it's playing and the selector agrees
+func (m *MPRIS) loadPlayer(owner string, follow bool) {
+	obj := m.conn.Object(owner, mprisPath)
+	identity := getIdentity(obj)
+	// Players may take a moment to export their object, PropertiesChanged fills in the rest
+	props, _ := getProperties(obj)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	player, ok := m.players[owner]
+	if !ok {
+		return
+	}
+	player.Identity = identity
+	player.Properties = props
+	m.notify()
+	if follow && props.PlaybackStatus == models.PlaybackStatusPlaying {
+		m.consider(owner)
+	}
+}
+
+// onNameOwnerChanged tracks players appearing and vanishing, and reports
+// whether the active player is gone. Must be called with m.mu held.
+func (m *MPRIS) onNameOwnerChanged(signal *dbus.Signal) bool {
+	if len(signal.Body) < 3 {
+		return false
+	}
+	name, _ := signal.Body[0].(string)
+	oldOwner, _ := signal.Body[1].(string)
+	newOwner, _ := signal.Body[2].(string)
+	if !strings.HasPrefix(name, mprisPrefix) {
+		return false
+	}
+	m.notify()
+	gone := false
+	if oldOwner != "" {
+		slog.Debug("player vanished", "player", name)
+		delete(m.players, oldOwner)
+		if oldOwner == m.active {
+			slog.Info("followed player vanished", "player", name)
+			m.deactivate()
+			gone = true
+			go m.startChecker("")
 		}
 	}
-	return backends
+	if newOwner != "" {
+		slog.Debug("player appeared", "player", name)
+		m.players[newOwner] = &PlayerInfo{Name: name}
+		go m.loadPlayer(newOwner, true)
+	}
+	return gone
+}
+
+// deactivate stops following the active player, must be called with m.mu held
+func (m *MPRIS) deactivate() {
+	if m.cancelChecker != nil {
+		m.cancelChecker()
+		m.cancelChecker = nil
+	}
+	m.active = ""
+	m.notify()
 }
 
-func (m *MPRIS) updatePosition(obj dbus.BusObject) {
+// selectPlayer returns the allowed playing player with the highest priority,
+// must be called with m.mu held
+func (m *MPRIS) selectPlayer() string {
+	var found string
+	rank := 0
+	for owner, player := range m.players {
+		if player.Properties.PlaybackStatus != models.PlaybackStatusPlaying || !m.selector.Allowed(player.Name, player.Identity) {
+			continue
+		}
+		r := m.selector.Rank(player.Name, player.Identity)
+		// Break ties by name so the choice doesn't depend on map order
+		if found == "" || r < rank || (r == rank && player.Name < m.players[found].Name) {
+			found, rank = owner, r
+		}
+	}
+	return found
+}
+
+// consider switches to a player that just started playing if the selector
+// allows it, must be called with m.mu held
+func (m *MPRIS) consider(owner string) {
+	if owner == m.active {
+		return
+	}
+	player := m.players[owner]
+	if !m.selector.Allowed(player.Name, player.Identity) {
+		slog.Debug("player ignored", "player", player.Name)
+		return
+	}
+	current, ok := m.players[m.active]
+	if !ok {
+		current = &PlayerInfo{}
+	}
+	playing := current.Properties.PlaybackStatus == models.PlaybackStatusPlaying
+	if !m.selector.Switch(current.Name, current.Identity, playing, player.Name, player.Identity) {
+		slog.Debug("player not followed", "player", player.Name, "current", current.Name)
+		return
+	}
+	go m.startChecker(owner)
+}
+
+// CurrentMetadata returns the track lrcd is showing. If lrcd is not running,
+// the player it would follow is picked with the selector, or the best ranked
+// allowed player with a track if none is playing.
+func CurrentMetadata(conn *dbus.Conn, selector *PlayerSelector) (models.MPRISMetadata, bool) {
+	var track map[string]dbus.Variant
+	err := daemonProperty(conn, "Track", &track)
+	if err == nil {
+		meta := parseTrack(track)
+		return meta, meta.Title != ""
+	} else if !errors.Is(err, ErrNotRunning) {
+		slog.Warn("failed to get the track from lrcd", "error", err)
+	}
+	m := NewMPRIS(nil, conn, selector)
+	m.scan()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if player, ok := m.players[m.selectPlayer()]; ok {
+		return player.Properties.Metadata, true
+	}
+	var found *PlayerInfo
+	rank := 0
+	for _, player := range m.players {
+		if player.Properties.Metadata.Title == "" || !selector.Allowed(player.Name, player.Identity) {
+			continue
+		}
+		r := selector.Rank(player.Name, player.Identity)
+		if found == nil || r < rank || (r == rank && player.Name < found.Name) {
+			found, rank = player, r
+		}
+	}
+	if found == nil {
+		return models.MPRISMetadata{}, false
+	}
+	return found.Properties.Metadata, true
+}
+
+func (m *MPRIS) updatePosition(owner string) {
 	var position int64
-	call := obj.Call(
+	call := m.conn.Object(owner, mprisPath).Call(
 		"org.freedesktop.DBus.Properties.Get", 0,
 		"org.mpris.MediaPlayer2.Player", "Position",
 	)
 	if call.Err != nil {
 		slog.Warn(call.Err.Error())
 		m.mu.Lock()
-		if m.cancelChecker != nil {
-			m.cancelChecker()
-			m.cancelChecker = nil
+		if m.active != owner {
+			m.mu.Unlock()
+			return
 		}
+		m.deactivate()
 		m.mu.Unlock()
 		m.propsCh <- models.MPRISProperties{}
 		return
 	}
 	call.Store(&position)
 	m.mu.Lock()
-	m.props.Position = int(position / 1000)
-	props := m.props.Clone()
+	player, ok := m.players[owner]
+	if !ok || m.active != owner {
+		m.mu.Unlock()
+		return
+	}
+	player.Properties.Position = int(position / 1000)
+	props := player.Properties.Clone()
 	m.mu.Unlock()
 	m.propsCh <- props
 }
 
-func (m *MPRIS) startChecker() {
-	var ctx context.Context
-	var cancel context.CancelFunc
-	var focus dbus.BusObject
-	for _, backend := range m.getBackends() {
-		call := backend.Call(
-			"org.freedesktop.DBus.Properties.GetAll", 0,
-			"org.mpris.MediaPlayer2.Player",
-		)
-		if call.Err != nil || len(call.Body) == 0 {
-			continue
-		}
-		properties := parseProperties(call.Body[0].(map[string]dbus.Variant))
-
-		if properties.PlaybackStatus != models.PlaybackStatusPlaying {
-			continue
-		}
-		ctx, cancel = context.WithCancel(context.Background())
-		m.propsCh <- properties.Clone()
-		m.props = properties
-		focus = backend
-		break
+// startChecker follows the player and polls its position while it's playing,
+// the best playing player is selected if owner is empty
+func (m *MPRIS) startChecker(owner string) {
+	m.mu.Lock()
+	if owner == "" {
+		owner = m.selectPlayer()
 	}
-	if cancel == nil {
+	player, ok := m.players[owner]
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+	properties, ok := getProperties(m.conn.Object(owner, mprisPath))
+	if !ok || properties.PlaybackStatus != models.PlaybackStatusPlaying {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.mu.Lock()
+	// The player may have vanished in the meantime
+	if m.players[owner] != player {
+		m.mu.Unlock()
+		cancel()
 		return
 	}
+	if m.cancelChecker != nil {
+		m.cancelChecker()
+	}
 	m.cancelChecker = cancel
-	m.updatePosition(focus)
+	if m.active != owner {
+		slog.Info("following player", "player", player.Name)
+	}
+	m.active = owner
+	player.Properties = properties
+	m.notify()
+	m.mu.Unlock()
+	m.propsCh <- properties.Clone()
+	m.updatePosition(owner)
 	ticker := time.NewTicker(2 * time.Second)
 	defer ticker.Stop()
 	for {
@@ -153,40 +420,69 @@ func (m *MPRIS) startChecker() {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			m.updatePosition(focus)
+			m.updatePosition(owner)
 		}
 	}
 }
 
-func (m *MPRIS) onPropertiesChanged(signal *dbus.Signal) {
-	if len(signal.Body) < 2 {
-		return
+// onPropertiesChanged updates the state of the sender, and reports whether it
+// is the active player. Must be called with m.mu held.
+func (m *MPRIS) onPropertiesChanged(signal *dbus.Signal) bool {
+	player, ok := m.players[signal.Sender]
+	if !ok || len(signal.Body) < 2 {
+		return false
+	}
+	p, ok := signal.Body[1].(map[string]dbus.Variant)
+	if !ok {
+		return false
 	}
-	p := signal.Body[1].(map[string]dbus.Variant)
+	m.notify()
 
 	if md, ok := p["Metadata"]; ok {
-		metadata := parseMetadata(md.Value().(map[string]dbus.Variant))
-		m.props.Metadata = metadata
+		if metadata, ok := md.Value().(map[string]dbus.Variant); ok {
+			player.Properties.Metadata = parseMetadata(metadata)
+		}
+	}
+	if rate, ok := p["Rate"]; ok {
+		player.Properties.Rate, _ = rate.Value().(float64)
 	}
-	if ps, ok := p["PlaybackStatus"]; ok {
+	ps, ok := p["PlaybackStatus"]
+	if ok {
 		var playbackStatus string
 		ps.Store(&playbackStatus)
-		m.props.PlaybackStatus = parsePlaybackStatus(playbackStatus)
+		player.Properties.PlaybackStatus = parsePlaybackStatus(playbackStatus)
+	}
+	if signal.Sender != m.active {
+		if ok && player.Properties.PlaybackStatus == models.PlaybackStatusPlaying {
+			m.consider(signal.Sender)
+		}
+		return false
+	}
+	if ok {
 		if m.cancelChecker != nil {
 			m.cancelChecker()
 			m.cancelChecker = nil
 		}
-		if m.props.PlaybackStatus == models.PlaybackStatusPlaying {
-			go m.startChecker()
+		if player.Properties.PlaybackStatus == models.PlaybackStatusPlaying {
+			go m.startChecker(m.active)
 		}
 	}
+	return true
 }
 
-func (m *MPRIS) onSeeked(signal *dbus.Signal) {
-	if len(signal.Body) == 0 {
-		return
+// onSeeked reports whether the active player seeked, must be called with m.mu
+// held
+func (m *MPRIS) onSeeked(signal *dbus.Signal) bool {
+	player, ok := m.players[signal.Sender]
+	if !ok || len(signal.Body) == 0 {
+		return false
 	}
-	m.props.Position = int(signal.Body[0].(int64) / 1000)
+	position, ok := signal.Body[0].(int64)
+	if !ok {
+		return false
+	}
+	player.Properties.Position = int(position / 1000)
+	return signal.Sender == m.active
 }
 
 func (m *MPRIS) Exit() {
@@ -227,9 +523,9 @@ func parseMetadata(m map[string]dbus.Variant) models.MPRISMetadata {
 	if duration, ok := m["mpris:length"]; ok {
 		meta.Duration = time.Duration(duration.Value().(int64)) * time.Microsecond
 	}
-	// if album, ok := m["xesam:album"]; ok {
-	// 	meta.Album = strings.TrimSpace(album.Value().(string))
-	// }
+	if album, ok := m["xesam:album"]; ok {
+		meta.Album = strings.TrimSpace(album.Value().(string))
+	}
 	return meta
 }
 
@@ -244,5 +540,8 @@ func parseProperties(p map[string]dbus.Variant) models.MPRISProperties {
 	if playbackStatus, ok := p["PlaybackStatus"]; ok {
 		props.PlaybackStatus = parsePlaybackStatus(playbackStatus.Value().(string))
 	}
+	if rate, ok := p["Rate"]; ok {
+		props.Rate, _ = rate.Value().(float64)
+	}
 	return props
 }
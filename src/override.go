@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"lrcd/models"
+	"lrcd/utils"
+)
+
+const OverrideSource = "user"
+
+const blacklistFilename = "blacklist"
+
+// Overrides are lyrics curated by the user, which win over the cache and the
+// providers, along with the results rejected by the user for each track
+type Overrides struct {
+	path string
+
+	mu        sync.Mutex
+	blacklist map[string]map[string]bool // Cache key to rejected `source/id`, loaded on first use
+}
+
+func NewOverrides(path string) *Overrides {
+	return &Overrides{path: path}
+}
+
+// Overrides are looked up for the exact track version first, then for any
+// version named `<title> - <artists>.lrc`
+func (o *Overrides) paths(meta *models.MPRISMetadata) []string {
+	return []string{
+		filepath.Join(o.path, strings.TrimSuffix(utils.FormatFilename(meta), ".cache")+".lrc"),
+		filepath.Join(o.path, strings.ReplaceAll(utils.FormatTrack(meta), "/", "_")+".lrc"),
+	}
+}
+
+func (o *Overrides) Get(meta *models.MPRISMetadata) (*models.Lyrics, error) {
+	if o == nil {
+		return nil, os.ErrNotExist
+	}
+	for _, path := range o.paths(meta) {
+		buf, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		lrc, err := utils.ParseLyrics(string(buf))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return &models.Lyrics{Lines: lrc.Lines, Source: OverrideSource}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// Set pins the lyrics for all versions of the track, in any format Get reads
+func (o *Overrides) Set(meta *models.MPRISMetadata, lrc string) error {
+	_, err := utils.ParseLyrics(lrc)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(o.path, 0o755)
+	if err != nil {
+		return err
+	}
+	path := o.paths(meta)[1]
+	err = os.WriteFile(path+".tmp", []byte(lrc), 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (o *Overrides) Delete(meta *models.MPRISMetadata) error {
+	for _, path := range o.paths(meta) {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Must be called with o.mu held
+func (o *Overrides) loadBlacklist() error {
+	if o.blacklist != nil {
+		return nil
+	}
+	o.blacklist = map[string]map[string]bool{}
+	buf, err := os.ReadFile(filepath.Join(o.path, blacklistFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for line := range strings.Lines(string(buf)) {
+		key, result, ok := strings.Cut(strings.TrimSuffix(line, "\n"), "\t")
+		if !ok {
+			continue
+		}
+		if o.blacklist[key] == nil {
+			o.blacklist[key] = map[string]bool{}
+		}
+		o.blacklist[key][result] = true
+	}
+	return nil
+}
+
+// Blocked reports whether the candidate was rejected for the track
+func (o *Overrides) Blocked(meta *models.MPRISMetadata, source string, id string) bool {
+	if o == nil || id == "" {
+		return false
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.loadBlacklist() != nil {
+		return false
+	}
+	return o.blacklist[indexEscaper.Replace(utils.CacheKey(meta))][indexEscaper.Replace(source+"/"+id)]
+}
+
+// Block rejects the candidate for the track, the blacklist is kept as lines of
+// `<cache key>\t<source>/<id>`
+func (o *Overrides) Block(meta *models.MPRISMetadata, source string, id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	err := o.loadBlacklist()
+	if err != nil {
+		return err
+	}
+	key := indexEscaper.Replace(utils.CacheKey(meta))
+	result := indexEscaper.Replace(source + "/" + id)
+	if o.blacklist[key][result] {
+		return nil
+	}
+	err = os.MkdirAll(o.path, 0o755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(o.path, blacklistFilename), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s\t%s\n", key, result)
+	if err != nil {
+		return err
+	}
+	if o.blacklist[key] == nil {
+		o.blacklist[key] = map[string]bool{}
+	}
+	o.blacklist[key][result] = true
+	return nil
+}
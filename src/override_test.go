@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lrcd/models"
+)
+
+func TestOverrides(t *testing.T) {
+	dir := t.TempDir()
+	overrides := NewOverrides(dir)
+	meta := &models.MPRISMetadata{
+		Title:    "春日影",
+		Artists:  []string{"CRYCHIC"},
+		Duration: 4 * time.Minute,
+	}
+	_, err := overrides.Get(meta)
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected no override, got %v", err)
+	}
+	err = overrides.Set(meta, "[00:01.00]any version\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lyrics, err := overrides.Get(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lyrics.Source != OverrideSource || lyrics.Get(0) != "any version" {
+		t.Errorf("unexpected lyrics %+v", lyrics)
+	}
+	// The exact track version wins
+	err = os.WriteFile(filepath.Join(dir, "春日影 - CRYCHIC (240s).lrc"), []byte("[00:01.00]this version\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lyrics, err = overrides.Get(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lyrics.Get(0) != "this version" {
+		t.Errorf("unexpected lyrics %+v", lyrics)
+	}
+	err = overrides.Delete(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = overrides.Get(meta)
+	if !os.IsNotExist(err) {
+		t.Errorf("expected no override after delete, got %v", err)
+	}
+
+	// Subtitles are pinned as they are
+	err = overrides.Set(meta, "1\n00:00:01,000 --> 00:00:02,500\nsubtitle\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lyrics, err = overrides.Get(meta)
+	if err != nil || lyrics.Get(0) != "subtitle" || lyrics.Lines[0].End != 2500 {
+		t.Errorf("unexpected lyrics %+v, %v", lyrics, err)
+	}
+	if overrides.Set(meta, "not lyrics") == nil {
+		t.Error("expected invalid lyrics to be rejected")
+	}
+
+	err = overrides.Block(meta, "lrclib", "42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The blacklist persists across instances
+	overrides = NewOverrides(dir)
+	if !overrides.Blocked(meta, "lrclib", "42") {
+		t.Error("candidate not blocked")
+	}
+	if overrides.Blocked(meta, "lrclib", "43") || overrides.Blocked(meta, "ncm", "42") {
+		t.Error("unrelated candidate blocked")
+	}
+	other := meta.Clone()
+	other.Duration = 5 * time.Minute
+	if overrides.Blocked(&other, "lrclib", "42") {
+		t.Error("candidate blocked for another version")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"lrcd/utils"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const overrideUsage = `usage: lrcd override <command> [arguments]
+
+commands:
+  set <file>        pin LRC, SRT, WebVTT or TTML lyrics for the currently playing track
+  delete            remove the pinned lyrics of the currently playing track
+
+Send SIGUSR1 to lrcd afterwards to apply the change to the current track.`
+
+func runOverrideCommand(dir string, selector *PlayerSelector, args []string) error {
+	if len(args) == 0 {
+		return errors.New(overrideUsage)
+	}
+	overrides := NewOverrides(dir)
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return fmt.Errorf("failed to connect to session bus: %w", err)
+	}
+	defer conn.Close()
+	meta, ok := CurrentMetadata(conn, selector)
+	if !ok || len(meta.Artists) == 0 {
+		return errors.New("no track is playing")
+	}
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "set":
+		if len(args) != 1 {
+			return errors.New("usage: lrcd override set <file>")
+		}
+		buf, err := os.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		err = overrides.Set(&meta, string(buf))
+		if err != nil {
+			return err
+		}
+		fmt.Println("pinned lyrics for", utils.FormatTrack(&meta))
+		return nil
+	case "delete", "rm":
+		err = overrides.Delete(&meta)
+		if err != nil {
+			return err
+		}
+		fmt.Println("removed pinned lyrics for", utils.FormatTrack(&meta))
+		return nil
+	}
+	return fmt.Errorf("unknown override command %q\n\n%s", cmd, overrideUsage)
+}
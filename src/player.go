@@ -0,0 +1,75 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+const (
+	mprisPrefix = "org.mpris.MediaPlayer2."
+	mprisPath   = "/org/mpris/MediaPlayer2"
+)
+
+// Which player to follow when another one starts playing
+type PlayerPolicy int
+
+const (
+	PlayerPolicyRecent PlayerPolicy = iota // Follow the most recently started player
+	PlayerPolicySticky                     // Stick to the current player while it's playing
+)
+
+// PlayerSelector decides which players lrcd follows. Players are matched by
+// bus name, with or without the MPRIS prefix and instance suffix (`firefox`
+// matches `org.mpris.MediaPlayer2.firefox.instance_1_23`), or by Identity,
+// case insensitively.
+type PlayerSelector struct {
+	Allow    []string // Empty to allow all players
+	Deny     []string
+	Priority []string // Preferred players first, unlisted ones come last
+	Policy   PlayerPolicy
+}
+
+func matchPlayer(pattern string, name string, identity string) bool {
+	pattern = strings.ToLower(pattern)
+	name = strings.ToLower(name)
+	short := strings.TrimPrefix(name, strings.ToLower(mprisPrefix))
+	return pattern == name || pattern == short || strings.HasPrefix(short, pattern+".") ||
+		(identity != "" && pattern == strings.ToLower(identity))
+}
+
+// Allowed is nil-safe, allowing all players
+func (s *PlayerSelector) Allowed(name string, identity string) bool {
+	if s == nil {
+		return true
+	}
+	match := func(pattern string) bool { return matchPlayer(pattern, name, identity) }
+	if slices.ContainsFunc(s.Deny, match) {
+		return false
+	}
+	return len(s.Allow) == 0 || slices.ContainsFunc(s.Allow, match)
+}
+
+// Rank returns the position of the player in the priority order, lower is
+// preferred
+func (s *PlayerSelector) Rank(name string, identity string) int {
+	if s == nil {
+		return 0
+	}
+	i := slices.IndexFunc(s.Priority, func(pattern string) bool { return matchPlayer(pattern, name, identity) })
+	if i == -1 {
+		return len(s.Priority)
+	}
+	return i
+}
+
+// Switch reports whether to leave the current player for one that just
+// started playing
+func (s *PlayerSelector) Switch(current string, currentIdentity string, playing bool, next string, nextIdentity string) bool {
+	if !playing {
+		return true
+	}
+	if s != nil && s.Policy == PlayerPolicySticky {
+		return false
+	}
+	return s.Rank(next, nextIdentity) <= s.Rank(current, currentIdentity)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+
+	"lrcd/models"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func TestPlayerSelector(t *testing.T) {
+	s := &PlayerSelector{
+		Deny:     []string{"firefox", "Chromium"},
+		Priority: []string{"spotify", "Music Player Daemon"},
+	}
+	if s.Allowed("org.mpris.MediaPlayer2.firefox.instance_1_23", "Mozilla Firefox") {
+		t.Error("denied instance allowed")
+	}
+	if s.Allowed("org.mpris.MediaPlayer2.chromium.instance42", "") {
+		t.Error("denied player allowed, case insensitively")
+	}
+	if !s.Allowed("org.mpris.MediaPlayer2.firefoxish", "") {
+		t.Error("player denied by a prefix")
+	}
+	s.Allow = []string{"spotify", "music player daemon"}
+	if !s.Allowed("org.mpris.MediaPlayer2.mpd", "Music Player Daemon") || s.Allowed("org.mpris.MediaPlayer2.vlc", "VLC media player") {
+		t.Error("allowlist not applied")
+	}
+	spotify := s.Rank("org.mpris.MediaPlayer2.spotify", "Spotify")
+	mpd := s.Rank("org.mpris.MediaPlayer2.mpd", "Music Player Daemon")
+	vlc := s.Rank("org.mpris.MediaPlayer2.vlc", "")
+	if spotify != 0 || mpd != 1 || vlc != 2 {
+		t.Errorf("unexpected ranks %d %d %d", spotify, mpd, vlc)
+	}
+	if !s.Switch("org.mpris.MediaPlayer2.mpd", "", true, "org.mpris.MediaPlayer2.spotify", "") {
+		t.Error("expected to switch to a preferred player")
+	}
+	if s.Switch("org.mpris.MediaPlayer2.spotify", "", true, "org.mpris.MediaPlayer2.vlc", "") {
+		t.Error("expected to stay on a preferred player")
+	}
+	s.Policy = PlayerPolicySticky
+	if s.Switch("org.mpris.MediaPlayer2.mpd", "", true, "org.mpris.MediaPlayer2.spotify", "") {
+		t.Error("expected to stick to the playing player")
+	}
+	if !s.Switch("org.mpris.MediaPlayer2.mpd", "", false, "org.mpris.MediaPlayer2.vlc", "") {
+		t.Error("expected to leave a paused player")
+	}
+	var none *PlayerSelector
+	if !none.Allowed("org.mpris.MediaPlayer2.vlc", "") || !none.Switch("a", "", true, "b", "") {
+		t.Error("nil selector should allow and follow every player")
+	}
+}
+
+func TestPlayerState(t *testing.T) {
+	m := NewMPRIS(nil, nil, &PlayerSelector{Deny: []string{"firefox"}, Priority: []string{"mpd"}})
+	m.players = map[string]*PlayerInfo{
+		":1.10": {Name: "org.mpris.MediaPlayer2.firefox", Properties: models.MPRISProperties{PlaybackStatus: models.PlaybackStatusPlaying}},
+		":1.11": {Name: "org.mpris.MediaPlayer2.vlc", Properties: models.MPRISProperties{PlaybackStatus: models.PlaybackStatusPlaying}},
+		":1.12": {Name: "org.mpris.MediaPlayer2.mpd", Properties: models.MPRISProperties{PlaybackStatus: models.PlaybackStatusPlaying}},
+		":1.13": {Name: "org.mpris.MediaPlayer2.spotify", Properties: models.MPRISProperties{PlaybackStatus: models.PlaybackStatusPaused}},
+	}
+	if owner := m.selectPlayer(); owner != ":1.12" {
+		t.Errorf("expected mpd to be selected, got %q", owner)
+	}
+	m.active = ":1.12"
+
+	// Metadata of another player must not leak into the active one
+	changed := m.onPropertiesChanged(&dbus.Signal{
+		Sender: ":1.13",
+		Body: []any{"org.mpris.MediaPlayer2.Player", map[string]dbus.Variant{
+			"Metadata": dbus.MakeVariant(map[string]dbus.Variant{"xesam:title": dbus.MakeVariant("Other")}),
+		}},
+	})
+	if changed {
+		t.Error("inactive player reported as changed")
+	}
+	select {
+	case <-m.Changes():
+	default:
+		t.Error("track change of an inactive player not signaled")
+	}
+	if !m.onSeeked(&dbus.Signal{Sender: ":1.12", Body: []any{int64(42000)}}) {
+		t.Error("active player seek not reported")
+	}
+
+	players := m.Players()
+	if len(players) != 4 || players[1].Name != "org.mpris.MediaPlayer2.mpd" || !players[1].Active || players[1].Properties.Position != 42 {
+		t.Fatalf("unexpected players %+v", players)
+	}
+	if players[2].Properties.Metadata.Title != "Other" || players[1].Properties.Metadata.Title != "" {
+		t.Errorf("metadata applied to the wrong player")
+	}
+	property := playerProperty(players)
+	if meta := parseTrack(property[2].Track); !property[1].Active || property[2].Status != "paused" || meta.Title != "Other" {
+		t.Errorf("unexpected property %+v", property)
+	}
+
+	// Nothing else to follow, the checker gives up without querying the bus
+	m.players[":1.11"].Properties.PlaybackStatus = models.PlaybackStatusStopped
+	if !m.onNameOwnerChanged(&dbus.Signal{Body: []any{"org.mpris.MediaPlayer2.mpd", ":1.12", ""}}) {
+		t.Error("active player vanishing not reported")
+	}
+	if m.active != "" || len(m.players) != 3 {
+		t.Errorf("player not removed, active %q", m.active)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"lrcd/utils"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// runPlayersCommand lists the players as seen by the running daemon, marking
+// the one it follows
+func runPlayersCommand(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: lrcd players")
+	}
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return fmt.Errorf("failed to connect to session bus: %w", err)
+	}
+	defer conn.Close()
+	var players []servicePlayer
+	err = daemonProperty(conn, "Players", &players)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\tPLAYER\tIDENTITY\tSTATUS\tTRACK")
+	for _, player := range players {
+		active := ""
+		if player.Active {
+			active = "*"
+		}
+		track := "-"
+		if meta := parseTrack(player.Track); meta.Title != "" {
+			track = utils.FormatTrack(&meta)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", active, strings.TrimPrefix(player.Name, mprisPrefix), player.Identity, player.Status, track)
+	}
+	return w.Flush()
+}
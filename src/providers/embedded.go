@@ -0,0 +1,57 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"iter"
+
+	"lrcd/models"
+	"lrcd/utils"
+)
+
+type EmbeddedProvider struct{}
+
+func NewEmbeddedProvider() *EmbeddedProvider {
+	return &EmbeddedProvider{}
+}
+
+func (*EmbeddedProvider) ID() string {
+	return EmbeddedProviderID
+}
+
+func (p *EmbeddedProvider) IterAll(ctx context.Context, meta *models.MPRISMetadata) (iter.Seq[*models.Candidate], error) {
+	return func(yield func(*models.Candidate) bool) {
+		path := localPath(meta.URL)
+		if path == "" {
+			return
+		}
+		embedded, err := utils.ReadEmbeddedLyrics(path)
+		if err != nil {
+			return
+		}
+		// Tags are read from the track itself, so they always match
+		candidate := &models.Candidate{
+			ID:       path,
+			Titles:   []string{meta.Title},
+			Artists:  meta.Artists,
+			Duration: meta.Duration,
+			Lyrics: func(ctx context.Context) (*models.Lyrics, error) {
+				lines := embedded.Lines
+				if len(lines) == 0 {
+					lrc, err := utils.ParseLyrics(embedded.Text)
+					if errors.Is(err, utils.ErrNotSynced) {
+						return plainLyrics(embedded.Text, p.ID())
+					} else if err != nil {
+						return nil, ErrParseFailure
+					}
+					lines = lrc.Lines
+				}
+				return &models.Lyrics{
+					Lines:  lines,
+					Source: p.ID(),
+				}, nil
+			},
+		}
+		yield(candidate)
+	}, nil
+}
@@ -0,0 +1,227 @@
+package providers
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errResponseTooLarge = fmt.Errorf("%w: response too large", ErrParseFailure)
+
+// ClientOptions configure the HTTP client shared by all providers
+type ClientOptions struct {
+	Proxy       string `yaml:"proxy"`         // Falls back to the environment variables if empty
+	Retries     *int   `yaml:"retries"`       // Retries after the first attempt, 0 to disable
+	Backoff     int    `yaml:"backoff"`       // Initial retry delay, milli
+	MaxBackoff  int    `yaml:"max_backoff"`   // milli
+	MaxBodySize int64  `yaml:"max_body_size"` // bytes
+}
+
+var (
+	httpClient  = &http.Client{Transport: newTransport(http.ProxyFromEnvironment)}
+	retries     = 4
+	backoff     = 250 * time.Millisecond
+	maxBackoff  = 5 * time.Second
+	maxBodySize = int64(8 << 20)
+)
+
+func newTransport(proxy func(*http.Request) (*url.URL, error)) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.MaxIdleConnsPerHost = 4
+	return transport
+}
+
+// Configure should be called before any provider is used
+func Configure(opt *ClientOptions) error {
+	proxy := http.ProxyFromEnvironment
+	if opt.Proxy != "" {
+		u, err := url.Parse(opt.Proxy)
+		if err != nil {
+			return fmt.Errorf("invalid proxy %q: %w", opt.Proxy, err)
+		}
+		proxy = http.ProxyURL(u)
+	}
+	if opt.Backoff < 0 || opt.MaxBackoff < 0 {
+		return fmt.Errorf("backoff and max_backoff must not be negative")
+	}
+	if opt.Retries != nil && *opt.Retries < 0 {
+		return fmt.Errorf("retries must not be negative")
+	}
+	httpClient = &http.Client{Transport: newTransport(proxy)}
+	if opt.Retries != nil {
+		retries = *opt.Retries
+	}
+	if opt.Backoff > 0 {
+		backoff = time.Duration(opt.Backoff) * time.Millisecond
+	}
+	if opt.MaxBackoff > 0 {
+		maxBackoff = time.Duration(opt.MaxBackoff) * time.Millisecond
+	}
+	if opt.MaxBodySize > 0 {
+		maxBodySize = opt.MaxBodySize
+	}
+	return nil
+}
+
+// HTTPOptions are shared by all network providers
+type HTTPOptions struct {
+	BaseURL   string            `yaml:"base_url"`
+	UserAgent string            `yaml:"user_agent"`
+	Headers   map[string]string `yaml:"headers"`
+	Limit     int               `yaml:"limit"`   // Max search results
+	Timeout   int               `yaml:"timeout"` // Per request, milli
+}
+
+type client struct {
+	baseURL string
+	headers []string
+	timeout time.Duration
+}
+
+func newClient(opt *HTTPOptions, baseURL string, headers ...string) *client {
+	for k, v := range opt.Headers {
+		headers = append(headers, k, v)
+	}
+	if opt.UserAgent != "" {
+		headers = append(headers, "User-Agent", opt.UserAgent)
+	}
+	return &client{
+		baseURL: cmp.Or(strings.TrimSuffix(opt.BaseURL, "/"), baseURL),
+		headers: headers,
+		timeout: time.Duration(opt.Timeout) * time.Millisecond,
+	}
+}
+
+// The per request timeout lasts until the response body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// Configured headers take precedence over the ones given here
+func (c *client) get(ctx context.Context, endpoint string, headers ...string) (*http.Response, error) {
+	headers = append(slices.Clone(headers), c.headers...)
+	if c.timeout <= 0 {
+		return get(ctx, c.baseURL+endpoint, headers...)
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	resp, err := get(ctx, c.baseURL+endpoint, headers...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// Fails the read instead of silently truncating oversized responses
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining <= 0 && err == nil {
+		return n, errResponseTooLarge
+	}
+	return n, err
+}
+
+// Exponential backoff with equal jitter, the shift is clamped before it
+// overflows
+func backoffDelay(attempt int) time.Duration {
+	d := backoff << min(attempt, 30)
+	if attempt > 30 || d <= 0 || d > maxBackoff {
+		d = maxBackoff
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// Retry-After is either delay seconds or an HTTP date
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(v); err == nil {
+		return time.Duration(max(sec, 0)) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+func get(ctx context.Context, url string, headers ...string) (*http.Response, error) {
+	slog.Debug("http get", "url", url)
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrNetworkFailure, err)
+		}
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		var wait time.Duration
+		resp, err := httpClient.Do(req)
+		switch {
+		case err != nil:
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				return nil, err
+			}
+			err = fmt.Errorf("%w: %w", ErrNetworkFailure, err)
+		case resp.StatusCode == http.StatusTooManyRequests:
+			wait = retryAfter(resp)
+			resp.Body.Close()
+			err = fmt.Errorf("%w: %s", ErrRateLimit, resp.Status)
+			if wait > maxBackoff {
+				return nil, err // Not worth waiting for
+			}
+		case resp.StatusCode >= 500:
+			wait = retryAfter(resp)
+			resp.Body.Close()
+			err = fmt.Errorf("%w: %s", ErrNetworkFailure, resp.Status)
+		case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+			// Some APIs answer missing lyrics with 404, which says nothing about their health
+			resp.Body.Close()
+			return nil, fmt.Errorf("%w: %s", ErrNoLyrics, resp.Status)
+		case resp.StatusCode >= 400:
+			resp.Body.Close()
+			return nil, fmt.Errorf("%w: %s", ErrNetworkFailure, resp.Status)
+		default:
+			resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: maxBodySize + 1}
+			return resp, nil
+		}
+		if attempt >= retries {
+			return nil, err
+		}
+		wait = min(max(wait, backoffDelay(attempt)), maxBackoff)
+		slog.Debug("http retry", "url", url, "error", err, "wait", wait)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
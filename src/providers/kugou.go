@@ -12,9 +12,21 @@ import (
 	"lrcd/utils"
 )
 
-const KugouBaseURL = "http://lyrics.kugou.com"
+const (
+	KugouBaseURL       = "http://lyrics.kugou.com"
+	KugouSearchBaseURL = "http://msearchcdn.kugou.com/api/v3"
+)
+
+type KugouProvider struct {
+	client       *client
+	searchClient *client
+	limit        int
+}
 
-type KugouProvider struct{}
+type KugouProviderOptions struct {
+	HTTPOptions   `yaml:",inline"`
+	SearchBaseURL string `yaml:"search_base_url"`
+}
 
 type KugouSinger struct {
 	Name string `json:"name"`
@@ -51,8 +63,14 @@ type KugouLyricsDownloadResponse struct {
 	Content string `json:"content"`
 }
 
-func NewKugouProvider() *KugouProvider {
-	return &KugouProvider{}
+func NewKugouProvider(opt *KugouProviderOptions) *KugouProvider {
+	searchOpt := opt.HTTPOptions
+	searchOpt.BaseURL = opt.SearchBaseURL
+	return &KugouProvider{
+		client:       newClient(&opt.HTTPOptions, KugouBaseURL),
+		searchClient: newClient(&searchOpt, KugouSearchBaseURL),
+		limit:        opt.Limit,
+	}
 }
 
 func (*KugouProvider) ID() string {
@@ -60,7 +78,7 @@ func (*KugouProvider) ID() string {
 }
 
 func (p *KugouProvider) IterAll(ctx context.Context, meta *models.MPRISMetadata) (iter.Seq[*models.Candidate], error) {
-	resp, err := get(ctx, "http://msearchcdn.kugou.com/api/v3/search/song?keyword="+queryStr(meta))
+	resp, err := p.searchClient.get(ctx, "/search/song?keyword="+queryStr(meta))
 	if err != nil {
 		return nil, err
 	}
@@ -71,15 +89,20 @@ func (p *KugouProvider) IterAll(ctx context.Context, meta *models.MPRISMetadata)
 		return nil, ErrParseFailure
 	}
 	return func(yield func(*models.Candidate) bool) {
-		for _, track := range body.Data.Info {
+		tracks := body.Data.Info
+		if p.limit > 0 && len(tracks) > p.limit {
+			tracks = tracks[:p.limit]
+		}
+		for _, track := range tracks {
 			titles := []string{track.SongName, track.SongNameOriginal, track.OtherName, track.OtherNameOriginal}
 			artists := []string{track.SingerName}
 			candidate := &models.Candidate{
+				ID:       track.Hash,
 				Titles:   titles,
 				Artists:  artists,
 				Duration: track.Duration,
 				Lyrics: func(ctx context.Context) (*models.Lyrics, error) {
-					resp, err = get(ctx, KugouBaseURL+"/search?ver=1&man=yes&client=pc&hash="+track.Hash)
+					resp, err := p.client.get(ctx, "/search?ver=1&man=yes&client=pc&hash="+track.Hash)
 					if err != nil {
 						return nil, err
 					}
@@ -90,7 +113,7 @@ func (p *KugouProvider) IterAll(ctx context.Context, meta *models.MPRISMetadata)
 						return nil, ErrParseFailure
 					}
 					for _, candidate := range body.Candidates {
-						resp, err = get(ctx, KugouBaseURL+"/download?ver=1&client=pc&id="+candidate.ID+"&accesskey="+candidate.Accesskey+"&fmt=lrc&charset=utf8")
+						resp, err := p.client.get(ctx, "/download?ver=1&client=pc&id="+candidate.ID+"&accesskey="+candidate.Accesskey+"&fmt=lrc&charset=utf8")
 						if err != nil {
 							if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 								return nil, err
@@ -107,15 +130,18 @@ func (p *KugouProvider) IterAll(ctx context.Context, meta *models.MPRISMetadata)
 						if err != nil {
 							continue
 						}
-						lines, err := utils.ParseLrc(string(bytes))
+						lrc, err := utils.ParseLrc(string(bytes))
 						if err != nil {
 							continue
 						}
-						if lines[0].Text == "纯音乐，请欣赏" {
-							continue
+						if lrc.Lines[0].Text == "纯音乐，请欣赏" {
+							return &models.Lyrics{
+								Source:       p.ID(),
+								Instrumental: true,
+							}, nil
 						}
 						return &models.Lyrics{
-							Lines:  lines,
+							Lines:  lrc.Lines,
 							Source: p.ID(),
 						}, nil
 					}
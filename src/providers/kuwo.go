@@ -1,9 +1,11 @@
 package providers
 
 import (
+	"cmp"
 	"context"
 	"encoding/json/v2"
 	"iter"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,7 +14,10 @@ import (
 
 const KuwoBaseURL = "https://kuwo.cn"
 
-type KuwoProvider struct{}
+type KuwoProvider struct {
+	client *client
+	limit  int
+}
 
 type KuwoAbs struct {
 	ID        string        `json:"DC_TARGETID"`
@@ -43,8 +48,11 @@ type KuwoGetResponse struct {
 	} `json:"data"`
 }
 
-func NewKuwoProvider() *KuwoProvider {
-	return &KuwoProvider{}
+func NewKuwoProvider(opt *HTTPOptions) *KuwoProvider {
+	return &KuwoProvider{
+		client: newClient(opt, KuwoBaseURL),
+		limit:  cmp.Or(opt.Limit, 20),
+	}
 }
 
 func (*KuwoProvider) ID() string {
@@ -81,7 +89,7 @@ func (p *KuwoProvider) parseLrcList(lrcList []*KuwoLrcLine) ([]*models.LyricLine
 }
 
 func (p *KuwoProvider) IterAll(ctx context.Context, meta *models.MPRISMetadata) (iter.Seq[*models.Candidate], error) {
-	resp, err := get(ctx, KuwoBaseURL+"/search/searchMusicBykeyWord?vipver=1&client=kt&ft=music&cluster=0&strategy=2012&encoding=utf8&rformat=json&mobi=1&issubtitle=1&pn=0&rn=20&all="+queryStr(meta))
+	resp, err := p.client.get(ctx, "/search/searchMusicBykeyWord?vipver=1&client=kt&ft=music&cluster=0&strategy=2012&encoding=utf8&rformat=json&mobi=1&issubtitle=1&pn=0&rn="+strconv.Itoa(p.limit)+"&all="+queryStr(meta))
 	if err != nil {
 		return nil, err
 	}
@@ -99,11 +107,12 @@ func (p *KuwoProvider) IterAll(ctx context.Context, meta *models.MPRISMetadata)
 			artists = append(artists, strings.Split(track.AArtist, "&")...)
 			artists = append(artists, strings.Split(track.FArtist, "&")...)
 			candidate := &models.Candidate{
+				ID:       track.ID,
 				Titles:   titles,
 				Artists:  artists,
 				Duration: track.Duration,
 				Lyrics: func(ctx context.Context) (*models.Lyrics, error) {
-					resp, err := get(ctx, KuwoBaseURL+"/openapi/v1/www/lyric/getlyric?musicId="+track.ID)
+					resp, err := p.client.get(ctx, "/openapi/v1/www/lyric/getlyric?musicId="+track.ID)
 					if err != nil {
 						return nil, err
 					}
@@ -0,0 +1,111 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"lrcd/models"
+	"lrcd/utils"
+)
+
+var localExts = []string{".lrc", ".txt", ".srt", ".vtt", ".ttml"}
+
+type LocalProvider struct {
+	dirs []string
+}
+
+type LocalProviderOptions struct {
+	Dirs []string // Extra directories containing `<artist> - <title>.lrc` or `<artist>/<title>.lrc`
+}
+
+func NewLocalProvider(opt *LocalProviderOptions) *LocalProvider {
+	return &LocalProvider{
+		dirs: opt.Dirs,
+	}
+}
+
+func (*LocalProvider) ID() string {
+	return LocalProviderID
+}
+
+// Resolve `file://` URLs reported by MPRIS to local paths
+func localPath(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "file" {
+		return ""
+	}
+	return u.Path
+}
+
+func (p *LocalProvider) paths(meta *models.MPRISMetadata) []string {
+	stems := []string{}
+	if path := localPath(meta.URL); path != "" {
+		stems = append(stems, strings.TrimSuffix(path, filepath.Ext(path)))
+	}
+	title := strings.ReplaceAll(meta.Title, "/", "_")
+	for _, dir := range p.dirs {
+		for _, artist := range meta.Artists {
+			artist = strings.ReplaceAll(artist, "/", "_")
+			stems = append(stems,
+				filepath.Join(dir, artist+" - "+title),
+				filepath.Join(dir, title+" - "+artist),
+				filepath.Join(dir, artist, title),
+			)
+		}
+		stems = append(stems, filepath.Join(dir, title))
+	}
+	paths := make([]string, 0, len(stems)*len(localExts))
+	for _, stem := range stems {
+		for _, ext := range localExts {
+			paths = append(paths, stem+ext)
+		}
+	}
+	return paths
+}
+
+func (p *LocalProvider) IterAll(ctx context.Context, meta *models.MPRISMetadata) (iter.Seq[*models.Candidate], error) {
+	return func(yield func(*models.Candidate) bool) {
+		for _, path := range p.paths(meta) {
+			if ctx.Err() != nil {
+				return
+			}
+			stat, err := os.Stat(path)
+			if err != nil || !stat.Mode().IsRegular() {
+				continue
+			}
+			buf, err := os.ReadFile(path)
+			if err != nil {
+				continue
+			}
+			lrc, err := utils.ParseLyrics(string(buf))
+			unsynced := errors.Is(err, utils.ErrNotSynced)
+			if unsynced {
+				lrc = utils.ParsePlain(string(buf))
+				if len(lrc.Lines) == 0 {
+					continue
+				}
+			} else if err != nil {
+				continue
+			}
+			// Files are looked up by the track itself, so they match unless their
+			// ID tags tell otherwise
+			candidate := lrc.Candidate(meta)
+			candidate.ID = path
+			candidate.Lyrics = func(ctx context.Context) (*models.Lyrics, error) {
+				return &models.Lyrics{
+					Lines:    lrc.Lines,
+					Source:   p.ID(),
+					Unsynced: unsynced,
+				}, nil
+			}
+			if !yield(candidate) {
+				return
+			}
+		}
+	}, nil
+}
@@ -0,0 +1,89 @@
+package providers
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lrcd/models"
+)
+
+func TestLocalPath(t *testing.T) {
+	cases := []struct {
+		url  string
+		path string
+	}{
+		{"file:///home/user/Music/song.flac", "/home/user/Music/song.flac"},
+		{"file:///home/user/Music/%E6%98%A5%E6%97%A5%E5%BD%B1%20(live).flac", "/home/user/Music/春日影 (live).flac"},
+		{"https://example.com/song.flac", ""},
+		{"", ""},
+	}
+	for _, c := range cases {
+		if path := localPath(c.url); path != c.path {
+			t.Errorf("%q: expected %q, got %q", c.url, c.path, path)
+		}
+	}
+}
+
+func TestLocalProvider(t *testing.T) {
+	music := t.TempDir()
+	lyricsDir := t.TempDir()
+	write := func(path string, text string) {
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err == nil {
+			err = os.WriteFile(path, []byte(text), 0o644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(music, "synced song.lrc"), "[00:01.00]sidecar")
+	write(filepath.Join(music, "plain song.txt"), "plain sidecar\n")
+	write(filepath.Join(lyricsDir, "Artist - Dash.lrc"), "[00:01.00]artist dash")
+	write(filepath.Join(lyricsDir, "Reversed - Artist.lrc"), "[00:01.00]title dash")
+	write(filepath.Join(lyricsDir, "Artist", "Nested.lrc"), "[00:01.00]nested")
+	write(filepath.Join(lyricsDir, "A_B - Slash_.lrc"), "[00:01.00]escaped")
+
+	fileURL := func(name string) string {
+		return (&url.URL{Scheme: "file", Path: filepath.Join(music, name)}).String()
+	}
+	p := NewLocalProvider(&LocalProviderOptions{Dirs: []string{lyricsDir}})
+	cases := []struct {
+		meta     models.MPRISMetadata
+		text     string
+		unsynced bool
+	}{
+		{models.MPRISMetadata{Title: "Sidecar", Artists: []string{"Artist"}, URL: fileURL("synced song.flac")}, "sidecar", false},
+		{models.MPRISMetadata{Title: "Sidecar", Artists: []string{"Artist"}, URL: fileURL("plain song.mp3")}, "plain sidecar", true},
+		{models.MPRISMetadata{Title: "Dash", Artists: []string{"Other", "Artist"}}, "artist dash", false},
+		{models.MPRISMetadata{Title: "Reversed", Artists: []string{"Artist"}}, "title dash", false},
+		{models.MPRISMetadata{Title: "Nested", Artists: []string{"Artist"}}, "nested", false},
+		{models.MPRISMetadata{Title: "Slash/", Artists: []string{"A/B"}}, "escaped", false},
+		{models.MPRISMetadata{Title: "Missing", Artists: []string{"Artist"}, URL: fileURL("missing.flac")}, "", false},
+	}
+	for _, c := range cases {
+		seq, err := p.IterAll(context.Background(), &c.meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found *models.Lyrics
+		for candidate := range seq {
+			found, err = candidate.Lyrics(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+		if c.text == "" {
+			if found != nil {
+				t.Errorf("%s: expected no lyrics, got %q", c.meta.Title, found.Get(0))
+			}
+			continue
+		}
+		if found == nil || found.Get(0) != c.text || found.Unsynced != c.unsynced {
+			t.Errorf("%s: expected %q, got %+v", c.meta.Title, c.text, found)
+		}
+	}
+}
@@ -6,27 +6,36 @@ import (
 	"errors"
 	"iter"
 	"net/url"
+	"strconv"
 	"time"
 
 	"lrcd/models"
 	"lrcd/utils"
 )
 
-type LRCLIBProvider struct{}
+const LRCLIBBaseURL = "https://lrclib.net/api"
+
+type LRCLIBProvider struct {
+	client *client
+	limit  int
+}
 
 type LRCLIBResponse []*struct {
 	TrackName    string        `json:"trackName"`
 	ArtistName   string        `json:"artistName"`
 	SyncedLyrics string        `json:"syncedLyrics"`
 	Duration     time.Duration `json:"duration,format:sec"`
-	// ID           int     `json:"id"`
+	Instrumental bool          `json:"instrumental"`
+	PlainLyrics  string        `json:"plainLyrics"`
+	ID           int           `json:"id"`
 	// AlbumName    string  `json:"albumName"`
-	// Instrumental bool    `json:"instrumental"`
-	// PlainLyrics  string  `json:"plainLyrics"`
 }
 
-func NewLRCLIBProvider() *LRCLIBProvider {
-	return &LRCLIBProvider{}
+func NewLRCLIBProvider(opt *HTTPOptions) *LRCLIBProvider {
+	return &LRCLIBProvider{
+		client: newClient(opt, LRCLIBBaseURL, "User-Agent", "lrcd"),
+		limit:  opt.Limit,
+	}
 }
 
 func (*LRCLIBProvider) ID() string {
@@ -38,8 +47,9 @@ func (p *LRCLIBProvider) IterAll(ctx context.Context, meta *models.MPRISMetadata
 		retFlag := false
 		queryAll := func(title string) {
 			for _, artist := range meta.Artists {
-				resp, err := get(ctx, "https://lrclib.net/api/search?track_name="+url.QueryEscape(title)+"&artist_name="+url.QueryEscape(artist), "User-Agent", "lrcd")
+				resp, err := p.client.get(ctx, "/search?track_name="+url.QueryEscape(title)+"&artist_name="+url.QueryEscape(artist))
 				if err != nil {
+					ReportFailure(ctx, err)
 					if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 						return
 					}
@@ -52,23 +62,34 @@ func (p *LRCLIBProvider) IterAll(ctx context.Context, meta *models.MPRISMetadata
 				body := LRCLIBResponse{}
 				err = json.UnmarshalRead(resp.Body, &body)
 				if err != nil {
+					ReportFailure(ctx, ErrParseFailure)
 					continue
 				}
+				if p.limit > 0 && len(body) > p.limit {
+					body = body[:p.limit]
+				}
 				for _, track := range body {
 					candidate := &models.Candidate{
+						ID:       strconv.Itoa(track.ID),
 						Titles:   []string{track.TrackName},
 						Artists:  []string{track.ArtistName},
 						Duration: track.Duration,
 						Lyrics: func(ctx context.Context) (*models.Lyrics, error) {
+							if track.Instrumental {
+								return &models.Lyrics{
+									Source:       p.ID(),
+									Instrumental: true,
+								}, nil
+							}
 							if track.SyncedLyrics == "" {
-								return nil, ErrNoLyrics
+								return plainLyrics(track.PlainLyrics, p.ID())
 							}
-							lines, err := utils.ParseLrc(track.SyncedLyrics)
+							lrc, err := utils.ParseLrc(track.SyncedLyrics)
 							if err != nil {
 								return nil, ErrParseFailure
 							}
 							return &models.Lyrics{
-								Lines:  lines,
+								Lines:  lrc.Lines,
 								Source: p.ID(),
 							}, nil
 						},
@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"cmp"
 	"context"
 	"encoding/json/jsontext"
 	"encoding/json/v2"
@@ -16,7 +17,9 @@ import (
 const MXMBaseURL = "https://apic-desktop.musixmatch.com/ws/1.1"
 
 type MXMProvider struct {
-	token string
+	client *client
+	limit  int
+	token  string
 }
 
 type MXMTrack struct {
@@ -70,8 +73,11 @@ type MXMArtistGetResponseBody struct {
 	} `json:"artist"`
 }
 
-func NewMXMProvider() *MXMProvider {
-	return &MXMProvider{}
+func NewMXMProvider(opt *HTTPOptions) *MXMProvider {
+	return &MXMProvider{
+		client: newClient(opt, MXMBaseURL, "Cookie", "AWSELB=unknown"),
+		limit:  cmp.Or(opt.Limit, 10),
+	}
 }
 
 func (*MXMProvider) ID() string {
@@ -86,7 +92,7 @@ func (p *MXMProvider) IterAll(ctx context.Context, meta *models.MPRISMetadata) (
 			return nil, err
 		}
 	}
-	b, err := p.getBody(ctx, "/track.search?page_size=10&page=1&q="+queryStr(meta))
+	b, err := p.getBody(ctx, "/track.search?page_size="+strconv.Itoa(p.limit)+"&page=1&q="+queryStr(meta))
 	if err != nil {
 		return nil, err
 	}
@@ -120,6 +126,7 @@ func (p *MXMProvider) IterAll(ctx context.Context, meta *models.MPRISMetadata) (
 				artistsMap[track.Track.ArtistID] = artists
 			}
 			candidate := &models.Candidate{
+				ID:       strconv.Itoa(track.Track.ID),
 				Titles:   titles,
 				Artists:  artists,
 				Duration: track.Track.TrackLength,
@@ -133,12 +140,12 @@ func (p *MXMProvider) IterAll(ctx context.Context, meta *models.MPRISMetadata) (
 					if err != nil {
 						return nil, ErrParseFailure
 					}
-					lines, err := utils.ParseLrc(body.Subtitle.SubtitleBody)
+					lrc, err := utils.ParseLrc(body.Subtitle.SubtitleBody)
 					if err != nil {
 						return nil, ErrParseFailure
 					}
 					return &models.Lyrics{
-						Lines:  lines,
+						Lines:  lrc.Lines,
 						Source: p.ID(),
 					}, nil
 				},
@@ -151,7 +158,7 @@ func (p *MXMProvider) IterAll(ctx context.Context, meta *models.MPRISMetadata) (
 }
 
 func (p *MXMProvider) updateToken(ctx context.Context) error {
-	resp, err := get(ctx, MXMBaseURL+"/token.get?app_id=web-desktop-app-v1.0", "Cookie", "AWSELB=unknown")
+	resp, err := p.client.get(ctx, "/token.get?app_id=web-desktop-app-v1.0")
 	if err != nil {
 		return err
 	}
@@ -169,7 +176,7 @@ func (p *MXMProvider) updateToken(ctx context.Context) error {
 }
 
 func (p *MXMProvider) getBody(ctx context.Context, endpoint string) (jsontext.Value, error) {
-	resp, err := get(ctx, MXMBaseURL+endpoint+"&app_id=web-desktop-app-v1.0&usertoken="+p.token, "Cookie", "AWSELB=unknown")
+	resp, err := p.client.get(ctx, endpoint+"&app_id=web-desktop-app-v1.0&usertoken="+p.token)
 	if err != nil {
 		return nil, err
 	}
@@ -184,9 +191,7 @@ func (p *MXMProvider) getBody(ctx context.Context, endpoint string) (jsontext.Va
 		if err != nil {
 			return nil, err
 		}
-		resp, err := get(ctx, endpoint+"&usertoken="+p.token,
-			"Cookie", "AWSELB=unknown",
-		)
+		resp, err := p.client.get(ctx, endpoint+"&app_id=web-desktop-app-v1.0&usertoken="+p.token)
 		if err != nil {
 			return nil, err
 		}
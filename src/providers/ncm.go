@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"cmp"
 	"context"
 	"encoding/json/jsontext"
 	"encoding/json/v2"
@@ -14,7 +15,10 @@ import (
 
 const NCMBaseURL = "https://music.163.com/api"
 
-type NCMProvider struct{}
+type NCMProvider struct {
+	client *client
+	limit  int
+}
 
 type NCMSong struct {
 	ID         int           `json:"id"`
@@ -40,14 +44,22 @@ type NCMSearchResponse struct {
 	} `json:"result"`
 }
 
+type NCMLyric struct {
+	Lyric string `json:"lyric"`
+}
+
 type NCMGetResponse struct {
-	Lrc struct {
-		Lyric string `json:"lyric"`
-	} `json:"lrc"`
+	Lrc       NCMLyric `json:"lrc"`
+	Tlyric    NCMLyric `json:"tlyric"`  // Translation
+	Romalrc   NCMLyric `json:"romalrc"` // Romanization
+	PureMusic bool     `json:"pureMusic"`
 }
 
-func NewNCMProvider() *NCMProvider {
-	return &NCMProvider{}
+func NewNCMProvider(opt *HTTPOptions) *NCMProvider {
+	return &NCMProvider{
+		client: newClient(opt, NCMBaseURL),
+		limit:  cmp.Or(opt.Limit, 30),
+	}
 }
 
 func (*NCMProvider) ID() string {
@@ -55,7 +67,7 @@ func (*NCMProvider) ID() string {
 }
 
 func (p *NCMProvider) IterAll(ctx context.Context, meta *models.MPRISMetadata) (iter.Seq[*models.Candidate], error) {
-	resp, err := get(ctx, NCMBaseURL+"/search/get/web?limit=30&type=1&s="+queryStr(meta))
+	resp, err := p.client.get(ctx, "/search/get/web?limit="+strconv.Itoa(p.limit)+"&type=1&s="+queryStr(meta))
 	if err != nil {
 		return nil, err
 	}
@@ -75,11 +87,12 @@ func (p *NCMProvider) IterAll(ctx context.Context, meta *models.MPRISMetadata) (
 				artists = append(artists, a.Alias...)
 			}
 			candidate := &models.Candidate{
+				ID:       strconv.Itoa(track.ID),
 				Titles:   titles,
 				Artists:  artists,
 				Duration: track.Duration,
 				Lyrics: func(ctx context.Context) (*models.Lyrics, error) {
-					resp, err := get(ctx, NCMBaseURL+"/song/lyric?lv=1&id="+strconv.Itoa(track.ID))
+					resp, err := p.client.get(ctx, "/song/lyric?lv=1&tv=-1&rv=-1&id="+strconv.Itoa(track.ID))
 					if err != nil {
 						return nil, err
 					}
@@ -89,12 +102,29 @@ func (p *NCMProvider) IterAll(ctx context.Context, meta *models.MPRISMetadata) (
 					if err != nil {
 						return nil, ErrParseFailure
 					}
-					lines, err := utils.ParseLrc(body.Lrc.Lyric)
+					if body.PureMusic {
+						return &models.Lyrics{
+							Source:       p.ID(),
+							Instrumental: true,
+						}, nil
+					}
+					lrc, err := utils.ParseLrc(body.Lrc.Lyric)
 					if err != nil {
 						return nil, ErrParseFailure
 					}
+					// Secondary tracks are optional, ignore them if they fail to parse
+					if tlrc, err := utils.ParseLrc(body.Tlyric.Lyric); err == nil {
+						for i, text := range utils.AlignLines(lrc.Lines, tlrc.Lines) {
+							lrc.Lines[i].Translation = text
+						}
+					}
+					if rlrc, err := utils.ParseLrc(body.Romalrc.Lyric); err == nil {
+						for i, text := range utils.AlignLines(lrc.Lines, rlrc.Lines) {
+							lrc.Lines[i].Romanization = text
+						}
+					}
 					return &models.Lyrics{
-						Lines:  lines,
+						Lines:  lrc.Lines,
 						Source: p.ID(),
 					}, nil
 				},
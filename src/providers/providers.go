@@ -4,21 +4,22 @@ import (
 	"context"
 	"errors"
 	"iter"
-	"log/slog"
-	"net/http"
 	"net/url"
 	"strings"
 
 	"lrcd/models"
+	"lrcd/utils"
 )
 
 // Provider ID should be within 6 bytes
 const (
-	LRCLIBProviderID = "lrclib"
-	NCMProviderID    = "ncm"
-	KugouProviderID  = "kugou"
-	KuwoProviderID   = "kuwo"
-	MXMProviderID    = "mxm"
+	LRCLIBProviderID   = "lrclib"
+	NCMProviderID      = "ncm"
+	KugouProviderID    = "kugou"
+	KuwoProviderID     = "kuwo"
+	MXMProviderID      = "mxm"
+	LocalProviderID    = "local"
+	EmbeddedProviderID = "embed"
 )
 
 var (
@@ -33,6 +34,42 @@ type Provider interface {
 	IterAll(context.Context, *models.MPRISMetadata) (iter.Seq[*models.Candidate], error)
 }
 
+type failuresKey struct{}
+
+// WithFailures returns a context through which providers that search lazily,
+// while their candidates are iterated, report searches that failed. Reports
+// also reach the reporters of the parent context.
+func WithFailures(ctx context.Context, report func(error)) context.Context {
+	parent, _ := ctx.Value(failuresKey{}).(func(error))
+	return context.WithValue(ctx, failuresKey{}, func(err error) {
+		report(err)
+		if parent != nil {
+			parent(err)
+		}
+	})
+}
+
+// ReportFailure is a no-op unless the context was given by WithFailures
+func ReportFailure(ctx context.Context, err error) {
+	if report, ok := ctx.Value(failuresKey{}).(func(error)); ok {
+		report(err)
+	}
+}
+
+// Offline providers read lyrics from the filesystem, which is not worth caching
+func IsOffline(id string) bool {
+	return id == LocalProviderID || id == EmbeddedProviderID
+}
+
+// Unsynced lyrics are flagged, the controller decides whether to use them
+func plainLyrics(text string, source string) (*models.Lyrics, error) {
+	lines := utils.ParsePlain(text).Lines
+	if len(lines) == 0 {
+		return nil, ErrNoLyrics
+	}
+	return &models.Lyrics{Lines: lines, Source: source, Unsynced: true}, nil
+}
+
 func queryStr(meta *models.MPRISMetadata) string {
 	strings.NewReplacer()
 	builder := &strings.Builder{}
@@ -43,30 +80,3 @@ func queryStr(meta *models.MPRISMetadata) string {
 	}
 	return url.QueryEscape(builder.String())
 }
-
-func get(ctx context.Context, url string, headers ...string) (*http.Response, error) {
-	var resp *http.Response
-	var err error
-	slog.Debug("http get", "url", url)
-	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
-	for i := 0; i < len(headers); i += 2 {
-		req.Header.Set(headers[i], headers[i+1])
-	}
-	for range 5 {
-		resp, err = http.DefaultClient.Do(req)
-		if err != nil {
-			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-				return nil, err
-			}
-			continue
-		}
-		if resp.StatusCode == 429 {
-			return nil, ErrRateLimit
-		}
-		break
-	}
-	if err != nil {
-		return nil, ErrNetworkFailure
-	}
-	return resp, nil
-}
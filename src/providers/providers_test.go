@@ -2,6 +2,9 @@ package providers
 
 import (
 	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"slices"
 	"testing"
 	"time"
@@ -58,21 +61,105 @@ func testProvider(t *testing.T, prov Provider) {
 }
 
 func TestLRCLIB(t *testing.T) {
-	testProvider(t, NewLRCLIBProvider())
+	testProvider(t, NewLRCLIBProvider(&HTTPOptions{}))
 }
 
 func TestKugou(t *testing.T) {
-	testProvider(t, NewKugouProvider())
+	testProvider(t, NewKugouProvider(&KugouProviderOptions{}))
 }
 
 func TestNCM(t *testing.T) {
-	testProvider(t, NewNCMProvider())
+	testProvider(t, NewNCMProvider(&HTTPOptions{}))
 }
 
 func TestKuwo(t *testing.T) {
-	testProvider(t, NewKuwoProvider())
+	testProvider(t, NewKuwoProvider(&HTTPOptions{}))
 }
 
 func TestMXM(t *testing.T) {
-	testProvider(t, NewMXMProvider())
+	testProvider(t, NewMXMProvider(&HTTPOptions{}))
+}
+
+func TestGetRetry(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		switch attempts {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer server.Close()
+	resp, err := get(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestGetNoRetries(t *testing.T) {
+	defer func(n int) { retries = n }(retries)
+	zero := 0
+	if err := Configure(&ClientOptions{Retries: &zero}); err != nil {
+		t.Fatal(err)
+	}
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	_, err := get(context.Background(), server.URL)
+	if !errors.Is(err, ErrNetworkFailure) || attempts != 1 {
+		t.Errorf("expected a single failed attempt, got %v after %d", err, attempts)
+	}
+	negative := -1
+	if err := Configure(&ClientOptions{Retries: &negative}); err == nil {
+		t.Error("expected negative retries to be rejected")
+	}
+}
+
+func TestGetRateLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	_, err := get(context.Background(), server.URL)
+	if !errors.Is(err, ErrRateLimit) {
+		t.Errorf("expected rate limit error, got %v", err)
+	}
+}
+
+func TestGetNotFound(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	_, err := get(context.Background(), server.URL)
+	if !errors.Is(err, ErrNoLyrics) || attempts != 1 {
+		t.Errorf("expected a single attempt failing with ErrNoLyrics, got %v after %d", err, attempts)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	for _, attempt := range []int{0, 1, 10, 36, 64, 1000} {
+		d := backoffDelay(attempt)
+		if d < 0 || d > maxBackoff {
+			t.Errorf("attempt %d: delay %v out of range", attempt, d)
+		}
+	}
+	if err := Configure(&ClientOptions{Backoff: -1}); err == nil {
+		t.Error("expected negative backoff to be rejected")
+	}
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"time"
+
+	"lrcd/models"
+	"lrcd/utils"
+)
+
+const (
+	DefaultMatchThreshold = 0.8
+
+	titleWeight    = 0.5
+	artistWeight   = 0.3
+	durationWeight = 0.2
+)
+
+// Durations within durationTolerance are considered identical, the score then
+// decreases linearly until durationCutoff
+const (
+	durationTolerance = 1 * time.Second
+	durationCutoff    = 6 * time.Second
+)
+
+type trackQuery struct {
+	name     string
+	title    string
+	altTitle string
+	artists  []string
+	duration time.Duration
+}
+
+func newTrackQuery(meta *models.MPRISMetadata) *trackQuery {
+	return &trackQuery{
+		name:     utils.FormatTrack(meta),
+		title:    utils.Normalize(meta.Title),
+		altTitle: utils.Normalize(utils.StripTitle(meta.Title)),
+		artists:  utils.SplitArtists(meta.Artists),
+		duration: meta.Duration,
+	}
+}
+
+func (q *trackQuery) titleScore(candidate *models.Candidate) float64 {
+	score := 0.0
+	for _, t := range candidate.Titles {
+		if t == "" {
+			continue
+		}
+		score = max(score,
+			utils.Similarity(utils.Normalize(t), q.title),
+			utils.Similarity(utils.Normalize(utils.StripTitle(t)), q.altTitle),
+		)
+	}
+	return score
+}
+
+func (q *trackQuery) artistScore(candidate *models.Candidate) float64 {
+	score := 0.0
+	for _, b := range utils.SplitArtists(candidate.Artists) {
+		for _, a := range q.artists {
+			score = max(score, utils.Similarity(a, b))
+		}
+	}
+	return score
+}
+
+func (q *trackQuery) durationScore(candidate *models.Candidate) float64 {
+	if q.duration == 0 || candidate.Duration == 0 {
+		return 0.5 // Nothing to compare against
+	}
+	diff := (q.duration - candidate.Duration).Abs()
+	if diff <= durationTolerance {
+		return 1
+	}
+	if diff >= durationCutoff {
+		return 0
+	}
+	return 1 - float64(diff-durationTolerance)/float64(durationCutoff-durationTolerance)
+}
+
+// Score combines the partial scores with a weighted geometric mean, so a
+// complete mismatch in any of them rejects the candidate
+func (q *trackQuery) Score(candidate *models.Candidate, source string) float64 {
+	title := q.titleScore(candidate)
+	artist := q.artistScore(candidate)
+	duration := q.durationScore(candidate)
+	score := math.Pow(title, titleWeight) * math.Pow(artist, artistWeight) * math.Pow(duration, durationWeight)
+	slog.Debug("candidate scored",
+		"track", q.name,
+		"source", source,
+		"titles", candidate.Titles,
+		"artists", candidate.Artists,
+		"duration", candidate.Duration,
+		"title_score", title,
+		"artist_score", artist,
+		"duration_score", duration,
+		"score", score,
+	)
+	return score
+}
+
+// Match scores this close to the best one are considered tied in
+// FetchModeBest, the richest lyrics win among them
+const rankTieMargin = 0.05
+
+// Lyrics fetched in FetchModeBest, with the score of their candidate
+type rankedLyrics struct {
+	lyrics *models.Lyrics
+	score  float64
+}
+
+// Instrumental results are only used if nobody has lyrics, and unsynced
+// lyrics if nobody has synced ones
+func lyricsTier(lyrics *models.Lyrics) int {
+	if lyrics.Len() == 0 {
+		return 0
+	}
+	if lyrics.Unsynced {
+		return 1
+	}
+	return 2
+}
+
+// pickBest returns the best match of the best tier, unless lyrics matching
+// within rankTieMargin of it have richer features
+func pickBest(ranked []rankedLyrics) *models.Lyrics {
+	tier := -1
+	bestScore := 0.0
+	for _, r := range ranked {
+		if t := lyricsTier(r.lyrics); t > tier || (t == tier && r.score > bestScore) {
+			tier, bestScore = t, r.score
+		}
+	}
+	var best *rankedLyrics
+	bestFeatures := 0.0
+	for i, r := range ranked {
+		if lyricsTier(r.lyrics) != tier || r.score < bestScore-rankTieMargin {
+			continue
+		}
+		features := lyricsFeatures(r.lyrics)
+		if best == nil || features > bestFeatures || (features == bestFeatures && r.score > best.score) {
+			best, bestFeatures = &ranked[i], features
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best.lyrics
+}
+
+// lyricsFeatures rates from 0 to 1 how much synced lyrics have to offer, it
+// never outweighs a better match
+func lyricsFeatures(lyrics *models.Lyrics) float64 {
+	if lyrics.Len() == 0 {
+		return 0
+	}
+	fine := 0
+	words := 0
+	secondary := false
+	for _, line := range lyrics.Lines {
+		if line.Position%1000 != 0 {
+			fine++
+		}
+		if len(line.Words) > 0 {
+			words++
+		}
+		if line.Translation != "" || line.Romanization != "" {
+			secondary = true
+		}
+	}
+	lineScore := min(float64(lyrics.Len())/20, 1)
+	resolutionScore := float64(fine) / float64(lyrics.Len())
+	wordScore := float64(words) / float64(lyrics.Len())
+	// Publishers may show a translation or romanization
+	secondaryScore := 0.0
+	if secondary {
+		secondaryScore = 1
+	}
+	return 0.35*lineScore + 0.15*resolutionScore + 0.35*wordScore + 0.15*secondaryScore
+}
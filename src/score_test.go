@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"lrcd/models"
+)
+
+func TestScore(t *testing.T) {
+	query := newTrackQuery(&models.MPRISMetadata{
+		Title:    "春日影",
+		Artists:  []string{"CRYCHIC"},
+		Duration: 4*time.Minute + 18*time.Second,
+	})
+	cases := []struct {
+		candidate *models.Candidate
+		accept    bool
+	}{
+		{&models.Candidate{Titles: []string{"春日影"}, Artists: []string{"CRYCHIC"}, Duration: 4*time.Minute + 18*time.Second}, true},
+		{&models.Candidate{Titles: []string{"春日影 (MyGO!!!!! ver.)"}, Artists: []string{"crychic"}, Duration: 4*time.Minute + 20*time.Second}, true},
+		{&models.Candidate{Titles: []string{"春日影"}, Artists: []string{"MyGO!!!!!"}, Duration: 4*time.Minute + 18*time.Second}, false},
+		{&models.Candidate{Titles: []string{"春日影"}, Artists: []string{"CRYCHIC"}, Duration: 5 * time.Minute}, false},
+	}
+	for _, c := range cases {
+		score := query.Score(c.candidate, "test")
+		if (score >= DefaultMatchThreshold) != c.accept {
+			t.Errorf("%v: unexpected score %f", c.candidate.Titles, score)
+		}
+	}
+}
+
+func TestScoreJoinedArtists(t *testing.T) {
+	query := newTrackQuery(&models.MPRISMetadata{
+		Title:   "Ｈｅｌｌｏ！",
+		Artists: []string{"A", "B"},
+	})
+	score := query.Score(&models.Candidate{Titles: []string{"hello!"}, Artists: []string{"B & C"}}, "test")
+	if score < DefaultMatchThreshold {
+		t.Errorf("unexpected score %f", score)
+	}
+}
+
+func TestRankLyrics(t *testing.T) {
+	lines := func(translation string) *models.Lyrics {
+		lyrics := &models.Lyrics{}
+		for i := range 10 {
+			lyrics.Lines = append(lyrics.Lines, &models.LyricLine{Position: i * 1000, Text: "line"})
+		}
+		lyrics.Lines[3].Translation = translation
+		return lyrics
+	}
+	plain := lyricsFeatures(lines(""))
+	translated := lyricsFeatures(lines("翻译"))
+	if translated <= plain {
+		t.Errorf("translation not rewarded: %f <= %f", translated, plain)
+	}
+	// The match score still dominates
+	if pickBest([]rankedLyrics{{lines("翻译"), 0.8}, {lines(""), 0.9}}).Lines[3].Translation != "" {
+		t.Error("translation outweighs a better match")
+	}
+	romanized := lines("")
+	romanized.Lines[0].Romanization = "romaji"
+	if lyricsFeatures(romanized) != translated {
+		t.Error("romanization ranked differently from translation")
+	}
+}
+
+func TestPickBest(t *testing.T) {
+	line := &models.Lyrics{Source: "lines"}
+	words := &models.Lyrics{Source: "words"}
+	for i := range 30 {
+		line.Lines = append(line.Lines, &models.LyricLine{Position: i * 1000, Text: "line"})
+		words.Lines = append(words.Lines, &models.LyricLine{Position: i*1000 + 250, Text: "line", Words: []*models.LyricWord{{Position: i*1000 + 250, Text: "line"}}})
+	}
+	plain := &models.Lyrics{Source: "plain", Unsynced: true, Lines: []*models.LyricLine{{Text: "line"}}}
+	instrumental := &models.Lyrics{Source: "instrumental", Instrumental: true}
+	cases := []struct {
+		ranked []rankedLyrics
+		source string
+	}{
+		// A marginal match must not win on features alone
+		{[]rankedLyrics{{words, 0.82}, {line, 1}}, "lines"},
+		// Features break ties between similar matches
+		{[]rankedLyrics{{line, 1}, {words, 0.97}}, "words"},
+		{[]rankedLyrics{{plain, 1}, {words, 0.82}}, "words"},
+		{[]rankedLyrics{{instrumental, 1}, {plain, 0.85}}, "plain"},
+		{[]rankedLyrics{{instrumental, 1}}, "instrumental"},
+	}
+	for _, c := range cases {
+		if best := pickBest(c.ranked); best == nil || best.Source != c.source {
+			t.Errorf("expected %s, got %+v", c.source, best)
+		}
+	}
+	if pickBest(nil) != nil {
+		t.Error("expected nil without candidates")
+	}
+}
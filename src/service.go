@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"time"
+
+	"lrcd/models"
+	"lrcd/utils"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+// The D-Bus publisher emits its Updated signal on the same path and interface
+// by default
+const (
+	busName      = "com.github.mechtifs.lrcd"
+	busPath      = "/com/github/mechtifs/lrcd"
+	busInterface = "com.github.mechtifs.lrcd"
+)
+
+var (
+	ErrAlreadyRunning = errors.New("lrcd is already running")
+	ErrNotRunning     = errors.New("lrcd is not running")
+)
+
+// RequestName owns the well-known bus name, so that a single instance runs at
+// a time
+func RequestName(conn *dbus.Conn) error {
+	reply, err := conn.RequestName(busName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		return fmt.Errorf("failed to request bus name: %w", err)
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		return ErrAlreadyRunning
+	}
+	return nil
+}
+
+// Service exports the controller on the bus, with its status and the players
+// as properties
+type Service struct {
+	controller *Controller
+	mpris      *MPRIS
+	props      *prop.Properties
+}
+
+// Only exported methods of this type are exposed
+type serviceMethods struct {
+	controller *Controller
+}
+
+func (m serviceMethods) Refetch() *dbus.Error {
+	m.controller.Refetch()
+	return nil
+}
+
+// NextCandidate blacklists the current lyrics, so the next best candidate is
+// fetched
+func (m serviceMethods) NextCandidate() *dbus.Error {
+	err := m.controller.Blacklist()
+	if err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+func (m serviceMethods) SetOffset(publisher string, offset int32) *dbus.Error {
+	err := m.controller.SetOffset(publisher, int(offset))
+	if err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+func (m serviceMethods) Pause() *dbus.Error {
+	m.controller.Pause()
+	return nil
+}
+
+func (m serviceMethods) Resume() *dbus.Error {
+	m.controller.Resume()
+	return nil
+}
+
+// Export serializes the lyrics being shown, see lrcd export
+func (m serviceMethods) Export(format string) (string, *dbus.Error) {
+	status := m.controller.Status()
+	if status.Track.Title == "" {
+		return "", dbus.MakeFailedError(errors.New("nothing is playing"))
+	}
+	if status.Lyrics == nil || status.Lyrics.Len() == 0 {
+		return "", dbus.MakeFailedError(fmt.Errorf("no lyrics for %s", utils.FormatTrack(&status.Track)))
+	}
+	data, err := formatLyrics(status.Lyrics, &status.Track, format)
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+	return string(data), nil
+}
+
+type serviceLine struct {
+	Start int32 // milli
+	End   int32 // milli
+	Text  string
+}
+
+type serviceOffset struct {
+	Publisher string
+	Offset    int32 // milli
+}
+
+type serviceProvider struct {
+	ID        string
+	State     string
+	Failures  int32 // Consecutive
+	Latency   int64 // milli, moving average
+	OpenUntil int64 // Unix milli, 0 unless the circuit is open
+}
+
+type servicePlayer struct {
+	Name     string
+	Identity string
+	Status   string
+	Active   bool // Followed by lrcd
+	Track    map[string]dbus.Variant
+}
+
+func NewService(conn *dbus.Conn, controller *Controller, mpris *MPRIS) (*Service, error) {
+	properties := map[string]*prop.Prop{
+		"Players": {Value: playerProperty(mpris.Players()), Emit: prop.EmitTrue},
+	}
+	for name, value := range statusProperties(controller.Status()) {
+		properties[name] = &prop.Prop{Value: value, Emit: prop.EmitTrue}
+	}
+	props, err := prop.Export(conn, busPath, prop.Map{busInterface: properties})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export properties: %w", err)
+	}
+	methods := serviceMethods{controller: controller}
+	err = conn.Export(methods, busPath, busInterface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export methods: %w", err)
+	}
+	node := &introspect.Node{
+		Name: busPath,
+		Interfaces: []introspect.Interface{
+			introspect.IntrospectData,
+			prop.IntrospectData,
+			{
+				Name:       busInterface,
+				Methods:    introspect.Methods(methods),
+				Properties: props.Introspection(busInterface),
+				Signals:    []introspect.Signal{{Name: "Updated", Args: []introspect.Arg{{Name: "line", Type: "s"}}}},
+			},
+		},
+	}
+	err = conn.Export(introspect.NewIntrospectable(node), busPath, "org.freedesktop.DBus.Introspectable")
+	if err != nil {
+		return nil, fmt.Errorf("failed to export introspection: %w", err)
+	}
+	return &Service{controller: controller, mpris: mpris, props: props}, nil
+}
+
+// trackProperty is empty if there is no track
+func trackProperty(meta *models.MPRISMetadata) map[string]dbus.Variant {
+	track := map[string]dbus.Variant{}
+	if meta.Title != "" {
+		track["title"] = dbus.MakeVariant(meta.Title)
+		track["artists"] = dbus.MakeVariant(append([]string{}, meta.Artists...))
+		track["album"] = dbus.MakeVariant(meta.Album)
+		track["duration"] = dbus.MakeVariant(meta.Duration.Milliseconds())
+	}
+	return track
+}
+
+// parseTrack is the reverse of trackProperty, for commands reading the
+// properties
+func parseTrack(track map[string]dbus.Variant) models.MPRISMetadata {
+	var meta models.MPRISMetadata
+	meta.Title, _ = track["title"].Value().(string)
+	meta.Artists, _ = track["artists"].Value().([]string)
+	meta.Album, _ = track["album"].Value().(string)
+	duration, _ := track["duration"].Value().(int64)
+	meta.Duration = time.Duration(duration) * time.Millisecond
+	return meta
+}
+
+func playerProperty(players []PlayerInfo) []servicePlayer {
+	property := make([]servicePlayer, len(players))
+	for i, player := range players {
+		property[i] = servicePlayer{
+			Name:     player.Name,
+			Identity: player.Identity,
+			Status:   player.Properties.PlaybackStatus.String(),
+			Active:   player.Active,
+			Track:    trackProperty(&player.Properties.Metadata),
+		}
+	}
+	return property
+}
+
+// statusProperties maps the status to the values of the exported properties
+func statusProperties(status ControllerStatus) map[string]any {
+	track := trackProperty(&status.Track)
+	lines := []serviceLine{}
+	var source, line, next string
+	if status.Lyrics != nil {
+		source = status.Lyrics.Source
+		line = status.Lyrics.Get(status.Line)
+		next = status.Lyrics.Get(status.Line + 1)
+		for i, line := range status.Lyrics.Lines {
+			lines = append(lines, serviceLine{
+				Start: int32(line.Position),
+				End:   int32(status.Lyrics.EndOf(i)),
+				Text:  line.Text,
+			})
+		}
+	}
+	offsets := make([]serviceOffset, len(status.Publishers))
+	for i, p := range status.Publishers {
+		offsets[i] = serviceOffset{Publisher: p.ID, Offset: int32(p.Offset)}
+	}
+	providers := make([]serviceProvider, len(status.Providers))
+	for i, h := range status.Providers {
+		providers[i] = serviceProvider{
+			ID:       h.ID,
+			State:    h.State.String(),
+			Failures: int32(h.Failures),
+			Latency:  h.Latency.Milliseconds(),
+		}
+		if h.State == BreakerOpen {
+			providers[i].OpenUntil = h.OpenUntil.UnixMilli()
+		}
+	}
+	return map[string]any{
+		"Track":     track,
+		"Line":      line,
+		"LineIndex": int32(status.Line),
+		"NextLine":  next,
+		"Lyrics":    lines,
+		"Source":    source,
+		"Offsets":   offsets,
+		"Paused":    status.Paused,
+		"Providers": providers,
+	}
+}
+
+// Serve updates the properties as the status and the players change
+func (s *Service) Serve() {
+	for {
+		select {
+		case <-s.controller.Changes():
+			s.update(statusProperties(s.controller.Status()))
+		case <-s.mpris.Changes():
+			s.update(map[string]any{"Players": playerProperty(s.mpris.Players())})
+		}
+	}
+}
+
+// update emits PropertiesChanged for each property that differs
+func (s *Service) update(properties map[string]any) {
+	for name, value := range properties {
+		if reflect.DeepEqual(s.props.GetMust(busInterface, name), value) {
+			continue
+		}
+		slog.Debug("property changed", "property", name)
+		s.props.SetMust(busInterface, name, value)
+	}
+}
+
+// daemonProperty reads a property of the running instance into value
+func daemonProperty(conn *dbus.Conn, name string, value any) error {
+	v, err := conn.Object(busName, busPath).GetProperty(busInterface + "." + name)
+	if err != nil {
+		return daemonError(err)
+	}
+	return v.Store(value)
+}
+
+// daemonError tells a missing instance apart from other errors
+func daemonError(err error) error {
+	var dbusErr dbus.Error
+	if errors.As(err, &dbusErr) && dbusErr.Name == "org.freedesktop.DBus.Error.ServiceUnknown" {
+		return ErrNotRunning
+	}
+	return err
+}
@@ -0,0 +1,397 @@
+package utils
+
+import (
+	"encoding/xml"
+	"errors"
+	"html"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"lrcd/models"
+)
+
+var ErrNoCues = errors.New("no timed lines")
+
+// ParseLyrics detects SRT, WebVTT and TTML by content, falling back to LRC
+func ParseLyrics(text string) (*Lrc, error) {
+	trimmed := strings.TrimLeft(text, "\uFEFF \t\r\n")
+	var lines []*models.LyricLine
+	var err error
+	switch {
+	case strings.HasPrefix(trimmed, "WEBVTT"):
+		lines, err = ParseVTT(text)
+	case strings.HasPrefix(trimmed, "<") && strings.Contains(trimmed, "<tt"):
+		lines, err = ParseTTML(text)
+	case isSRT(trimmed):
+		lines, err = ParseSRT(text)
+	default:
+		return ParseLrc(text)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Lrc{Lines: lines, Tags: map[string][]string{}}, nil
+}
+
+// An SRT file starts with a cue index, or directly with a timing line
+func isSRT(text string) bool {
+	first, rest, _ := strings.Cut(text, "\n")
+	if strings.Contains(first, "-->") {
+		return true
+	}
+	if _, err := strconv.Atoi(strings.TrimSpace(first)); err != nil {
+		return false
+	}
+	second, _, _ := strings.Cut(rest, "\n")
+	return strings.Contains(second, "-->")
+}
+
+// Parse `hh:mm:ss.fff`, `mm:ss.fff` or `hh:mm:ss,fff` into milliseconds
+func parseClock(s string) (int, bool) {
+	s = strings.TrimSpace(s)
+	sec, frac, _ := strings.Cut(strings.Replace(s, ",", ".", 1), ".")
+	position := 0
+	parts := strings.Split(sec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, false
+	}
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		position = position*60 + n
+	}
+	position *= 1000
+	if frac != "" {
+		if len(frac) > 3 {
+			frac = frac[:3]
+		}
+		n, err := strconv.Atoi(frac)
+		if err != nil {
+			return 0, false
+		}
+		for range 3 - len(frac) {
+			n *= 10
+		}
+		position += n
+	}
+	return position, true
+}
+
+// Parse a `start --> end [settings]` cue timing line
+func parseCueTiming(line string) (int, int, bool) {
+	start, end, ok := strings.Cut(line, "-->")
+	if !ok {
+		return 0, 0, false
+	}
+	end = strings.TrimSpace(end)
+	if i := strings.IndexAny(end, " \t"); i != -1 {
+		end = end[:i]
+	}
+	startPos, ok := parseClock(start)
+	if !ok {
+		return 0, 0, false
+	}
+	endPos, ok := parseClock(end)
+	if !ok {
+		return 0, 0, false
+	}
+	return startPos, endPos, true
+}
+
+// Cues are separated by blank lines, multi-line cue text is joined by spaces
+func splitCues(text string) [][]string {
+	text = strings.ReplaceAll(strings.TrimPrefix(text, "\uFEFF"), "\r\n", "\n")
+	cues := [][]string{}
+	for block := range strings.SplitSeq(text, "\n\n") {
+		lines := []string{}
+		for line := range strings.SplitSeq(strings.Trim(block, "\n"), "\n") {
+			lines = append(lines, strings.TrimRight(line, " \t\r"))
+		}
+		if len(lines) > 0 && lines[0] != "" {
+			cues = append(cues, lines)
+		}
+	}
+	return cues
+}
+
+func sortLines(lines []*models.LyricLine) ([]*models.LyricLine, error) {
+	if len(lines) == 0 {
+		return nil, ErrNoCues
+	}
+	slices.SortStableFunc(lines, func(a, b *models.LyricLine) int { return a.Position - b.Position })
+	return lines, nil
+}
+
+func ParseSRT(text string) ([]*models.LyricLine, error) {
+	lines := []*models.LyricLine{}
+	for _, cue := range splitCues(text) {
+		i := slices.IndexFunc(cue, func(line string) bool { return strings.Contains(line, "-->") })
+		if i == -1 {
+			continue
+		}
+		start, end, ok := parseCueTiming(cue[i])
+		if !ok {
+			continue
+		}
+		text := stripTags(strings.Join(cue[i+1:], " "))
+		lines = append(lines, &models.LyricLine{Position: start, End: end, Text: text})
+	}
+	return sortLines(lines)
+}
+
+func ParseVTT(text string) ([]*models.LyricLine, error) {
+	lines := []*models.LyricLine{}
+	for _, cue := range splitCues(text) {
+		// Header, comments, styles and regions
+		if strings.HasPrefix(cue[0], "WEBVTT") || strings.HasPrefix(cue[0], "NOTE") || cue[0] == "STYLE" || cue[0] == "REGION" {
+			continue
+		}
+		i := slices.IndexFunc(cue, func(line string) bool { return strings.Contains(line, "-->") })
+		if i == -1 {
+			continue
+		}
+		start, end, ok := parseCueTiming(cue[i])
+		if !ok {
+			continue
+		}
+		text, words := parseVTTWords(strings.Join(cue[i+1:], " "), start)
+		lines = append(lines, &models.LyricLine{Position: start, End: end, Text: text, Words: words})
+	}
+	return sortLines(lines)
+}
+
+// Remove markup such as `<i>`, `<c.class>` or `<font>` and unescape entities
+func stripTags(s string) string {
+	builder := &strings.Builder{}
+	for {
+		i := strings.IndexByte(s, '<')
+		if i == -1 {
+			builder.WriteString(s)
+			break
+		}
+		j := strings.IndexByte(s[i:], '>')
+		if j == -1 {
+			builder.WriteString(s)
+			break
+		}
+		builder.WriteString(s[:i])
+		s = s[i+j+1:]
+	}
+	return strings.TrimSpace(html.UnescapeString(builder.String()))
+}
+
+// WebVTT karaoke cues split words with inline timestamps like `<00:01.500>`
+func parseVTTWords(s string, position int) (string, []*models.LyricWord) {
+	words := []*models.LyricWord{}
+	wordPos := position
+	stamped := false
+	builder := &strings.Builder{}
+	flush := func() {
+		if text := html.UnescapeString(builder.String()); strings.TrimSpace(text) != "" {
+			words = append(words, &models.LyricWord{Position: wordPos, Text: text})
+		}
+		builder.Reset()
+	}
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '<')
+		if i == -1 {
+			builder.WriteString(s)
+			break
+		}
+		j := strings.IndexByte(s[i:], '>')
+		if j == -1 {
+			builder.WriteString(s)
+			break
+		}
+		builder.WriteString(s[:i])
+		// Other tags are dropped
+		if p, ok := parseClock(s[i+1 : i+j]); ok {
+			flush()
+			wordPos = p
+			stamped = true
+		}
+		s = s[i+j+1:]
+	}
+	flush()
+	text := strings.Join(strings.Fields(joinWords(words)), " ")
+	if !stamped {
+		return text, nil
+	}
+	trimWords(words)
+	return text, words
+}
+
+func joinWords(words []*models.LyricWord) string {
+	builder := &strings.Builder{}
+	for _, w := range words {
+		builder.WriteString(w.Text)
+	}
+	return builder.String()
+}
+
+func trimWords(words []*models.LyricWord) {
+	if len(words) > 0 {
+		words[0].Text = strings.TrimLeft(words[0].Text, " ")
+		words[len(words)-1].Text = strings.TrimRight(words[len(words)-1].Text, " ")
+	}
+}
+
+// Parse TTML clock times (`00:01:02.345`, `01:02.345`, `62.345`) and offset
+// times (`62.3s`, `62345ms`, `1.5m`, `1h`) into milliseconds
+func parseTTMLTime(s string) (int, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, false
+	}
+	if strings.Contains(s, ":") {
+		return parseClock(s)
+	}
+	unit := 1000.0
+	switch {
+	case strings.HasSuffix(s, "ms"):
+		s, unit = s[:len(s)-2], 1
+	case strings.HasSuffix(s, "s"):
+		s = s[:len(s)-1]
+	case strings.HasSuffix(s, "m"):
+		s, unit = s[:len(s)-1], 60_000
+	case strings.HasSuffix(s, "h"):
+		s, unit = s[:len(s)-1], 3_600_000
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		return 0, false
+	}
+	return int(f*unit + 0.5), true
+}
+
+func xmlAttr(e xml.StartElement, name string) (string, bool) {
+	for _, attr := range e.Attr {
+		if attr.Name.Local == name {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
+// ParseTTML reads `<p>` elements as lines and timed `<span>` elements as words,
+// along with the translations and transliterations of Apple Music TTML
+func ParseTTML(text string) ([]*models.LyricLine, error) {
+	decoder := xml.NewDecoder(strings.NewReader(text))
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+	lines := []*models.LyricLine{}
+	keys := []string{}
+	translations := map[string]string{}
+	romanizations := map[string]string{}
+
+	var line *models.LyricLine
+	var words []*models.LyricWord
+	var lineText strings.Builder
+	var secondary map[string]string // Set within <translation> or <transliteration>
+	secondaryKey := ""
+	var secondaryText strings.Builder
+
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "translation":
+				secondary = translations
+			case "transliteration":
+				secondary = romanizations
+			case "text":
+				if secondary != nil {
+					secondaryKey, _ = xmlAttr(t, "for")
+					secondaryText.Reset()
+				}
+			case "p":
+				begin, _ := xmlAttr(t, "begin")
+				position, ok := parseTTMLTime(begin)
+				if !ok {
+					continue
+				}
+				line = &models.LyricLine{Position: position}
+				if end, ok := xmlAttr(t, "end"); ok {
+					line.End, _ = parseTTMLTime(end)
+				}
+				key, _ := xmlAttr(t, "key")
+				keys = append(keys, key)
+				words = nil
+				lineText.Reset()
+			case "span":
+				if line == nil {
+					continue
+				}
+				begin, _ := xmlAttr(t, "begin")
+				position, ok := parseTTMLTime(begin)
+				if ok {
+					words = append(words, &models.LyricWord{Position: position})
+				}
+			case "br":
+				if line != nil {
+					lineText.WriteByte(' ')
+				}
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "translation", "transliteration":
+				secondary = nil
+			case "text":
+				if secondary != nil && secondaryKey != "" {
+					secondary[secondaryKey] = strings.Join(strings.Fields(secondaryText.String()), " ")
+				}
+				secondaryKey = ""
+			case "p":
+				if line == nil {
+					continue
+				}
+				words = slices.DeleteFunc(words, func(w *models.LyricWord) bool { return strings.TrimSpace(w.Text) == "" })
+				if len(words) > 0 {
+					trimWords(words)
+					line.Words = words
+					line.Text = strings.Join(strings.Fields(joinWords(words)), " ")
+				} else {
+					line.Text = strings.Join(strings.Fields(lineText.String()), " ")
+				}
+				lines = append(lines, line)
+				line = nil
+			}
+		case xml.CharData:
+			if secondary != nil && secondaryKey != "" {
+				secondaryText.Write(t)
+				continue
+			}
+			if line == nil {
+				continue
+			}
+			data := string(t)
+			if strings.TrimSpace(data) == "" {
+				data = " "
+			}
+			lineText.WriteString(data)
+			if len(words) == 0 {
+				continue
+			}
+			// Text between timed spans belongs to the previous word
+			words[len(words)-1].Text += data
+		}
+	}
+	for i, line := range lines {
+		if keys[i] == "" {
+			continue
+		}
+		line.Translation = translations[keys[i]]
+		line.Romanization = romanizations[keys[i]]
+	}
+	return sortLines(lines)
+}
@@ -0,0 +1,415 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+
+	"lrcd/models"
+)
+
+// Metadata blocks larger than this are most likely cover arts, skip them
+const maxTagSize = 16 << 20
+
+var ErrNoTags = errors.New("no lyrics tags")
+
+type EmbeddedLyrics struct {
+	Lines []*models.LyricLine // Synced lyrics from ID3v2 SYLT frames
+	Text  string              // Unsynced or LRC formatted lyrics text
+}
+
+func (e *EmbeddedLyrics) empty() bool {
+	return len(e.Lines) == 0 && e.Text == ""
+}
+
+// ReadEmbeddedLyrics extracts lyrics from ID3v2, FLAC, Ogg and MP4 tags
+func ReadEmbeddedLyrics(path string) (*EmbeddedLyrics, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	e := &EmbeddedLyrics{}
+	magic := make([]byte, 8)
+	_, err = io.ReadFull(f, magic)
+	if err != nil {
+		return nil, err
+	}
+	var offset int64
+	if bytes.HasPrefix(magic, []byte("ID3")) {
+		offset, err = readID3(f, e)
+		if err != nil {
+			return nil, err
+		}
+		// FLAC files are sometimes prefixed with an ID3v2 tag
+		_, err = f.ReadAt(magic, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte("fLaC")):
+		err = readFLAC(f, offset+4, e)
+	case bytes.HasPrefix(magic, []byte("OggS")):
+		err = readOgg(io.NewSectionReader(f, offset, 1<<62), e)
+	case bytes.Equal(magic[4:], []byte("ftyp")):
+		err = readMP4(f, offset, 1<<62, e)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if e.empty() {
+		return nil, ErrNoTags
+	}
+	return e, nil
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0])<<21 | int(b[1])<<14 | int(b[2])<<7 | int(b[3])
+}
+
+// Returns the offset right after the tag
+func readID3(f *os.File, e *EmbeddedLyrics) (int64, error) {
+	header := make([]byte, 10)
+	_, err := f.ReadAt(header, 0)
+	if err != nil {
+		return 0, err
+	}
+	version := header[3]
+	flags := header[5]
+	size := syncsafe(header[6:])
+	end := int64(10 + size)
+	if flags&0x10 != 0 { // Footer present
+		end += 10
+	}
+	if size > maxTagSize {
+		return end, nil
+	}
+	tag := make([]byte, size)
+	_, err = f.ReadAt(tag, 10)
+	if err != nil {
+		return 0, err
+	}
+	if flags&0x80 != 0 && version < 4 {
+		tag = bytes.ReplaceAll(tag, []byte{0xff, 0x00}, []byte{0xff})
+	}
+	if flags&0x40 != 0 && len(tag) >= 4 { // Extended header
+		extSize := int(binary.BigEndian.Uint32(tag)) + 4
+		if version >= 4 {
+			extSize = syncsafe(tag)
+		}
+		if extSize > len(tag) {
+			return end, nil
+		}
+		tag = tag[extSize:]
+	}
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	for len(tag) >= headerLen && tag[0] != 0 {
+		id := string(tag[:idLen])
+		var frameSize int
+		switch version {
+		case 2:
+			frameSize = int(tag[3])<<16 | int(tag[4])<<8 | int(tag[5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(tag[4:]))
+		default:
+			frameSize = syncsafe(tag[4:])
+		}
+		if frameSize > len(tag)-headerLen {
+			break
+		}
+		frame := tag[headerLen : headerLen+frameSize]
+		tag = tag[headerLen+frameSize:]
+		switch id {
+		case "SYLT", "SLT":
+			if len(e.Lines) == 0 {
+				e.Lines = parseSYLT(frame)
+			}
+		case "USLT", "ULT":
+			if e.Text == "" {
+				e.Text = parseUSLT(frame)
+			}
+		}
+	}
+	return end, nil
+}
+
+// Split a terminated string in the given ID3 encoding
+func splitID3String(b []byte, encoding byte) (string, []byte) {
+	if encoding == 1 || encoding == 2 {
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				return decodeID3String(b[:i], encoding), b[i+2:]
+			}
+		}
+		return decodeID3String(b, encoding), nil
+	}
+	i := bytes.IndexByte(b, 0)
+	if i == -1 {
+		return decodeID3String(b, encoding), nil
+	}
+	return decodeID3String(b[:i], encoding), b[i+1:]
+}
+
+func decodeID3String(b []byte, encoding byte) string {
+	switch encoding {
+	case 0: // ISO-8859-1
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return string(runes)
+	case 1, 2: // UTF-16 with BOM, UTF-16BE
+		var order binary.ByteOrder = binary.BigEndian
+		if len(b) >= 2 && b[0] == 0xff && b[1] == 0xfe {
+			order = binary.LittleEndian
+			b = b[2:]
+		} else if len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff {
+			b = b[2:]
+		}
+		units := make([]uint16, len(b)/2)
+		for i := range units {
+			units[i] = order.Uint16(b[i*2:])
+		}
+		return string(utf16.Decode(units))
+	}
+	return string(b)
+}
+
+func parseUSLT(frame []byte) string {
+	if len(frame) < 4 {
+		return ""
+	}
+	encoding := frame[0]
+	_, rest := splitID3String(frame[4:], encoding)
+	text, _ := splitID3String(rest, encoding)
+	return text
+}
+
+func parseSYLT(frame []byte) []*models.LyricLine {
+	if len(frame) < 6 || frame[4] != 2 { // Only absolute milliseconds are supported
+		return nil
+	}
+	encoding := frame[0]
+	_, data := splitID3String(frame[6:], encoding)
+	type entry struct {
+		text     string
+		position int
+	}
+	entries := []entry{}
+	newlines := false
+	for len(data) > 0 {
+		var text string
+		text, data = splitID3String(data, encoding)
+		if len(data) < 4 {
+			break
+		}
+		entries = append(entries, entry{text, int(binary.BigEndian.Uint32(data))})
+		data = data[4:]
+		if strings.HasPrefix(text, "\n") || strings.HasPrefix(text, "\r") {
+			newlines = true
+		}
+	}
+	lines := []*models.LyricLine{}
+	if !newlines {
+		for _, e := range entries {
+			lines = append(lines, &models.LyricLine{Position: e.position, Text: strings.TrimSpace(e.text)})
+		}
+		return lines
+	}
+	// Entries are syllables, where a leading line break starts a new line
+	var line *models.LyricLine
+	for _, e := range entries {
+		if line == nil || strings.HasPrefix(e.text, "\n") || strings.HasPrefix(e.text, "\r") {
+			line = &models.LyricLine{Position: e.position}
+			lines = append(lines, line)
+		}
+		text := strings.TrimLeft(e.text, "\r\n")
+		line.Words = append(line.Words, &models.LyricWord{Position: e.position, Text: text})
+		line.Text += text
+	}
+	for _, line := range lines {
+		line.Text = strings.TrimSpace(line.Text)
+	}
+	return lines
+}
+
+func readFLAC(f *os.File, offset int64, e *EmbeddedLyrics) error {
+	header := make([]byte, 4)
+	for {
+		_, err := f.ReadAt(header, offset)
+		if err != nil {
+			return err
+		}
+		last := header[0]&0x80 != 0
+		blockType := header[0] & 0x7f
+		size := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+		offset += 4
+		if blockType == 4 && size <= maxTagSize {
+			block := make([]byte, size)
+			_, err = f.ReadAt(block, offset)
+			if err != nil {
+				return err
+			}
+			parseVorbisComments(block, e)
+			return nil
+		}
+		offset += size
+		if last {
+			return nil
+		}
+	}
+}
+
+func parseVorbisComments(b []byte, e *EmbeddedLyrics) {
+	if len(b) < 4 {
+		return
+	}
+	vendorLen := int(binary.LittleEndian.Uint32(b))
+	if vendorLen+8 > len(b) {
+		return
+	}
+	b = b[vendorLen+4:]
+	count := int(binary.LittleEndian.Uint32(b))
+	b = b[4:]
+	var synced, unsynced string
+	for range count {
+		if len(b) < 4 {
+			break
+		}
+		n := int(binary.LittleEndian.Uint32(b))
+		if n+4 > len(b) {
+			break
+		}
+		key, value, ok := strings.Cut(string(b[4:4+n]), "=")
+		b = b[4+n:]
+		if !ok {
+			continue
+		}
+		switch strings.ToUpper(key) {
+		case "SYNCEDLYRICS":
+			synced = value
+		case "LYRICS", "UNSYNCEDLYRICS":
+			unsynced = value
+		}
+	}
+	if synced != "" {
+		e.Text = synced
+	} else if e.Text == "" {
+		e.Text = unsynced
+	}
+}
+
+// Comment headers are the second packet of the logical stream
+func readOgg(r io.Reader, e *EmbeddedLyrics) error {
+	header := make([]byte, 27)
+	packet := []byte{}
+	packets := 0
+	for {
+		_, err := io.ReadFull(r, header)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(header[:4], []byte("OggS")) {
+			return nil
+		}
+		segments := make([]byte, header[26])
+		_, err = io.ReadFull(r, segments)
+		if err != nil {
+			return err
+		}
+		for _, size := range segments {
+			buf := make([]byte, size)
+			_, err = io.ReadFull(r, buf)
+			if err != nil {
+				return err
+			}
+			packet = append(packet, buf...)
+			if len(packet) > maxTagSize {
+				return nil
+			}
+			if size == 255 {
+				continue
+			}
+			if packets == 1 {
+				switch {
+				case bytes.HasPrefix(packet, []byte("\x03vorbis")):
+					parseVorbisComments(packet[7:], e)
+				case bytes.HasPrefix(packet, []byte("OpusTags")):
+					parseVorbisComments(packet[8:], e)
+				}
+				return nil
+			}
+			packets++
+			packet = packet[:0]
+		}
+	}
+}
+
+// Walk moov/udta/meta/ilst/©lyr/data
+func readMP4(f *os.File, offset int64, end int64, e *EmbeddedLyrics) error {
+	header := make([]byte, 16)
+	for offset+8 <= end {
+		n, err := f.ReadAt(header, offset)
+		if n < 8 {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		name := string(header[4:8])
+		headerLen := int64(8)
+		switch size {
+		case 0:
+			stat, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			size = stat.Size() - offset
+		case 1:
+			if n < 16 {
+				return nil
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:]))
+			headerLen = 16
+		}
+		if size < headerLen {
+			return nil
+		}
+		switch name {
+		case "moov", "udta", "ilst", "meta":
+			childOffset := offset + headerLen
+			if name == "meta" {
+				childOffset += 4 // Skip version and flags
+			}
+			err = readMP4(f, childOffset, offset+size, e)
+			if err != nil || e.Text != "" {
+				return err
+			}
+		case "\xa9lyr":
+			if size > maxTagSize {
+				return nil
+			}
+			data := make([]byte, size-headerLen)
+			_, err = f.ReadAt(data, offset+headerLen)
+			if err != nil {
+				return err
+			}
+			// data atom: size, "data", type, locale, value
+			if len(data) >= 16 && string(data[4:8]) == "data" {
+				e.Text = string(data[16:])
+			}
+			return nil
+		}
+		offset += size
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadEmbeddedLyricsID3(t *testing.T) {
+	// SYLT: UTF-8, "eng", milliseconds, lyrics, empty descriptor
+	frame := []byte{3, 'e', 'n', 'g', 2, 1, 0}
+	for _, e := range []struct {
+		text     string
+		position uint32
+	}{{"Hello", 1000}, {"\nWorld", 2500}} {
+		frame = append(frame, e.text...)
+		frame = append(frame, 0)
+		frame = binary.BigEndian.AppendUint32(frame, e.position)
+	}
+	tag := []byte("SYLT")
+	tag = binary.BigEndian.AppendUint32(tag, uint32(len(frame)))
+	tag = append(tag, 0, 0)
+	tag = append(tag, frame...)
+	data := []byte{'I', 'D', '3', 3, 0, 0, 0, 0, 0, byte(len(tag))}
+	data = append(data, tag...)
+
+	path := filepath.Join(t.TempDir(), "test.mp3")
+	err := os.WriteFile(path, append(data, make([]byte, 16)...), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := ReadEmbeddedLyrics(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Lines) != 2 || e.Lines[0].Text != "Hello" || e.Lines[1].Position != 2500 || e.Lines[1].Text != "World" {
+		t.Errorf("unexpected lines %+v", e.Lines)
+	}
+}
+
+func TestReadEmbeddedLyricsFLAC(t *testing.T) {
+	comment := "LYRICS=[00:01.00]Hello"
+	block := binary.LittleEndian.AppendUint32(nil, 0)
+	block = binary.LittleEndian.AppendUint32(block, 1)
+	block = binary.LittleEndian.AppendUint32(block, uint32(len(comment)))
+	block = append(block, comment...)
+	data := []byte("fLaC")
+	data = append(data, 0x84, 0, 0, byte(len(block)))
+	data = append(data, block...)
+
+	path := filepath.Join(t.TempDir(), "test.flac")
+	err := os.WriteFile(path, data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := ReadEmbeddedLyrics(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Text != "[00:01.00]Hello" {
+		t.Errorf("unexpected text %q", e.Text)
+	}
+}
+
+func vorbisComments(comments ...string) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, 6)
+	b = append(b, "vendor"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(comments)))
+	for _, c := range comments {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(c)))
+		b = append(b, c...)
+	}
+	return b
+}
+
+func oggPage(segments []byte, body []byte) []byte {
+	page := []byte("OggS")
+	page = append(page, make([]byte, 22)...) // Version, type, granule, serial, sequence and CRC are not checked
+	page = append(page, byte(len(segments)))
+	page = append(page, segments...)
+	return append(page, body...)
+}
+
+func TestReadEmbeddedLyricsOgg(t *testing.T) {
+	long := strings.Repeat("x", 400)
+	cases := []struct {
+		name   string
+		header string
+		prefix string
+		text   string
+	}{
+		{"vorbis", "\x01vorbis", "\x03vorbis", "[00:01.00]Hello"},
+		{"opus", "OpusHead", "OpusTags", "[00:01.00]Hello"},
+	}
+	for _, c := range cases {
+		packet := append([]byte(c.prefix), vorbisComments("TITLE="+long, "LYRICS=plain", "SYNCEDLYRICS="+c.text)...)
+		// The comment packet spans two pages, laced in 255 byte segments
+		lacing := []byte{}
+		for n := len(packet); ; n -= 255 {
+			if n < 255 {
+				lacing = append(lacing, byte(n))
+				break
+			}
+			lacing = append(lacing, 255)
+		}
+		data := oggPage([]byte{byte(len(c.header))}, []byte(c.header))
+		data = append(data, oggPage(lacing[:1], packet[:255])...)
+		data = append(data, oggPage(lacing[1:], packet[255:])...)
+
+		path := filepath.Join(t.TempDir(), "test.ogg")
+		err := os.WriteFile(path, data, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := ReadEmbeddedLyrics(path)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if e.Text != c.text {
+			t.Errorf("%s: unexpected text %q", c.name, e.Text)
+		}
+	}
+}
+
+func mp4Box(name string, body ...[]byte) []byte {
+	size := 8
+	for _, b := range body {
+		size += len(b)
+	}
+	box := binary.BigEndian.AppendUint32(nil, uint32(size))
+	box = append(box, name...)
+	for _, b := range body {
+		box = append(box, b...)
+	}
+	return box
+}
+
+func TestReadEmbeddedLyricsMP4(t *testing.T) {
+	data := mp4Box("ftyp", []byte("M4A \x00\x00\x00\x00"))
+	// Boxes with a 64-bit size are skipped by their extended size
+	large := binary.BigEndian.AppendUint32(nil, 1)
+	large = append(large, "mdat"...)
+	large = binary.BigEndian.AppendUint64(large, 24)
+	large = append(large, make([]byte, 8)...)
+	data = append(data, large...)
+	lyrics := mp4Box("data", []byte{0, 0, 0, 1, 0, 0, 0, 0}, []byte("[00:01.00]Hello"))
+	ilst := mp4Box("ilst", mp4Box("\xa9nam", mp4Box("data", make([]byte, 8), []byte("Title"))), mp4Box("\xa9lyr", lyrics))
+	meta := mp4Box("meta", []byte{0, 0, 0, 0}, mp4Box("hdlr", make([]byte, 25)), ilst)
+	data = append(data, mp4Box("moov", mp4Box("mvhd", make([]byte, 100)), mp4Box("udta", meta))...)
+
+	path := filepath.Join(t.TempDir(), "test.m4a")
+	err := os.WriteFile(path, data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := ReadEmbeddedLyrics(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Text != "[00:01.00]Hello" {
+		t.Errorf("unexpected text %q", e.Text)
+	}
+}
@@ -2,9 +2,16 @@ package utils
 
 import (
 	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"lrcd/models"
 )
@@ -29,12 +36,95 @@ func FormatTrack(meta *models.MPRISMetadata) string {
 	return builder.String()
 }
 
+// Durations are rounded to buckets, so that players reporting slightly
+// different lengths share an entry while different cuts of a track don't
+const durationBucket = 5 * time.Second
+
+// Longer names are hashed to stay within the filesystem limit of 255 bytes
+const maxFilenameLen = 200
+
+// CacheKey identifies a track version by its title, artists, album and duration
+func CacheKey(meta *models.MPRISMetadata) string {
+	key := FormatTrack(meta)
+	if meta.Album != "" {
+		key += " [" + meta.Album + "]"
+	}
+	if meta.Duration > 0 {
+		key += fmt.Sprintf(" (%ds)", int(meta.Duration.Round(durationBucket)/time.Second))
+	}
+	return key
+}
+
 func FormatFilename(meta *models.MPRISMetadata) string {
-	return strings.ReplaceAll(FormatTrack(meta), "/", "_") + ".cache"
+	key := CacheKey(meta)
+	if len(key) > maxFilenameLen || strings.ContainsAny(key, "/\x00") {
+		sum := sha256.Sum256([]byte(key))
+		return hex.EncodeToString(sum[:16]) + ".cache"
+	}
+	return key + ".cache"
+}
+
+// Lrc is a parsed LRC file, where the ID tags are kept raw in Tags and the
+// common ones are also parsed into fields
+type Lrc struct {
+	Lines   []*models.LyricLine // The offset is already applied
+	Title   string              // [ti:]
+	Artists []string            // [ar:], may be repeated
+	Album   string              // [al:]
+	Length  time.Duration       // [length:]
+	Offset  int                 // [offset:], milli, positive shows lyrics sooner
+	Tags    map[string][]string // Keyed by lowercased name
+}
+
+// Candidate describes the track the LRC claims to be for, falling back to meta
+// where tags are missing
+func (l *Lrc) Candidate(meta *models.MPRISMetadata) *models.Candidate {
+	candidate := &models.Candidate{
+		Titles:   []string{cmp.Or(l.Title, meta.Title)},
+		Artists:  l.Artists,
+		Duration: cmp.Or(l.Length, meta.Duration),
+	}
+	if len(candidate.Artists) == 0 {
+		candidate.Artists = meta.Artists
+	}
+	return candidate
 }
 
-func ParseLrc(lrc string) ([]*models.LyricLine, error) {
+func (l *Lrc) parseTag(line []byte) {
+	s := strings.TrimSpace(string(line))
+	if !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") {
+		return
+	}
+	key, value, ok := strings.Cut(s[1:len(s)-1], ":")
+	if !ok || key == "" || strings.IndexFunc(key, func(r rune) bool { return !unicode.IsLetter(r) }) != -1 {
+		return
+	}
+	key = strings.ToLower(key)
+	value = strings.TrimSpace(value)
+	l.Tags[key] = append(l.Tags[key], value)
+	switch key {
+	case "ti":
+		l.Title = value
+	case "ar":
+		if value != "" {
+			l.Artists = append(l.Artists, value)
+		}
+	case "al":
+		l.Album = value
+	case "length":
+		if p, ok := parseLRCPosition([]byte(value)); ok {
+			l.Length = time.Duration(p) * time.Millisecond
+		}
+	case "offset":
+		if offset, err := strconv.Atoi(value); err == nil {
+			l.Offset = offset
+		}
+	}
+}
+
+func ParseLrc(lrc string) (*Lrc, error) {
 	data := []byte(lrc)
+	result := &Lrc{Tags: map[string][]string{}}
 	lines := []*models.LyricLine{}
 	for len(data) > 0 {
 		var line []byte
@@ -50,6 +140,7 @@ func ParseLrc(lrc string) ([]*models.LyricLine, error) {
 			data = data[lineLen+1:]
 		}
 
+		raw := line
 		postitions := []int{}
 		for len(line) > 0 && line[0] == '[' {
 			j := bytes.IndexByte(line, ']')
@@ -63,16 +154,137 @@ func ParseLrc(lrc string) ([]*models.LyricLine, error) {
 			postitions = append(postitions, p)
 			line = line[j+1:]
 		}
-		text := string(bytes.TrimSpace(line))
+		if len(postitions) == 0 {
+			result.parseTag(raw)
+			continue
+		}
+		text, words, end := parseLrcWords(line, postitions[0])
 		for _, t := range postitions {
-			lines = append(lines, &models.LyricLine{Position: t, Text: text})
+			lyricLine := &models.LyricLine{Position: t, Text: text}
+			if end != 0 {
+				lyricLine.End = end - postitions[0] + t
+			}
+			if len(words) > 0 {
+				// Word stamps are absolute, shift them for repeated lines
+				lyricLine.Words = make([]*models.LyricWord, len(words))
+				for i, w := range words {
+					lyricLine.Words[i] = &models.LyricWord{Position: w.Position - postitions[0] + t, Text: w.Text}
+				}
+			}
+			lines = append(lines, lyricLine)
 		}
 	}
 	if len(lines) == 0 {
-		return nil, errors.New("lrc not synced")
+		return nil, ErrNotSynced
+	}
+	if result.Offset != 0 {
+		for _, line := range lines {
+			line.Position -= result.Offset
+			if line.End != 0 {
+				line.End -= result.Offset
+			}
+			for _, word := range line.Words {
+				word.Position -= result.Offset
+			}
+		}
+	}
+	slices.SortStableFunc(lines, func(a, b *models.LyricLine) int { return a.Position - b.Position })
+	result.Lines = mergeSecondary(lines)
+	return result, nil
+}
+
+// Lines sharing a timestamp are secondary tracks of the first one, the second
+// being the translation and the third the romanization
+func mergeSecondary(lines []*models.LyricLine) []*models.LyricLine {
+	merged := lines[:0]
+	for _, line := range lines {
+		n := len(merged)
+		if n == 0 || merged[n-1].Position != line.Position {
+			merged = append(merged, line)
+			continue
+		}
+		prev := merged[n-1]
+		switch {
+		case line.Text == "":
+		case prev.Text == "":
+			merged[n-1] = line
+		case prev.Translation == "":
+			prev.Translation = line.Text
+		case prev.Romanization == "":
+			prev.Romanization = line.Text
+		}
+	}
+	return merged
+}
+
+// Secondary lines further than this from any line are dropped when aligning
+const alignTolerance = 100 // milli
+
+// AlignLines returns the text of the secondary line matching each line by position
+func AlignLines(lines []*models.LyricLine, secondary []*models.LyricLine) []string {
+	texts := make([]string, len(lines))
+	j := 0
+	for i, line := range lines {
+		for j < len(secondary) && secondary[j].Position < line.Position-alignTolerance {
+			j++
+		}
+		if j < len(secondary) && secondary[j].Position <= line.Position+alignTolerance {
+			texts[i] = secondary[j].Text
+			j++
+		}
+	}
+	return texts
+}
+
+// Parse enhanced LRC word stamps like `<00:12.34>word <00:12.80>word`, a
+// trailing stamp like `<00:13.20>` is the end of the line
+func parseLrcWords(line []byte, position int) (string, []*models.LyricWord, int) {
+	if bytes.IndexByte(line, '<') == -1 {
+		return string(bytes.TrimSpace(line)), nil, 0
+	}
+	words := []*models.LyricWord{}
+	builder := &strings.Builder{}
+	raw := line
+	stamped := false
+	wordPos := position
+	for len(line) > 0 {
+		i := bytes.IndexByte(line, '<')
+		j := -1
+		if i != -1 {
+			j = bytes.IndexByte(line[i:], '>')
+		}
+		var p int
+		ok := false
+		if j != -1 {
+			p, ok = parseLRCPosition(line[i+1 : i+j])
+		}
+		if !ok {
+			// Not a word stamp, treat the rest as plain text
+			i = len(line)
+		}
+		if i > 0 && len(bytes.TrimSpace(line[:i])) > 0 {
+			words = append(words, &models.LyricWord{Position: wordPos, Text: string(line[:i])})
+			builder.Write(line[:i])
+		}
+		if !ok {
+			break
+		}
+		stamped = true
+		wordPos = p
+		line = line[i+j+1:]
+	}
+	if !stamped {
+		return string(bytes.TrimSpace(raw)), nil, 0
+	}
+	end := 0
+	if len(words) > 0 {
+		words[0].Text = strings.TrimLeft(words[0].Text, " ")
+		words[len(words)-1].Text = strings.TrimRight(words[len(words)-1].Text, " ")
+		if wordPos > words[len(words)-1].Position {
+			end = wordPos
+		}
 	}
-	slices.SortFunc(lines, func(a, b *models.LyricLine) int { return a.Position - b.Position })
-	return lines, nil
+	return strings.TrimSpace(builder.String()), words, end
 }
 
 func parseLRCPosition(s []byte) (int, bool) {
@@ -117,6 +329,30 @@ func parseLRCPosition(s []byte) (int, bool) {
 	return position, true
 }
 
+var ErrNotSynced = errors.New("lrc not synced")
+
+// ParsePlain reads unsynced lyrics as lines at position 0, keeping single empty
+// lines between stanzas and reading ID tags like ParseLrc
+func ParsePlain(text string) *Lrc {
+	result := &Lrc{Tags: map[string][]string{}}
+	for line := range strings.Lines(text) {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") && strings.Contains(line, ":") {
+			result.parseTag([]byte(line))
+			continue
+		}
+		n := len(result.Lines)
+		if line == "" && (n == 0 || result.Lines[n-1].Text == "") {
+			continue
+		}
+		result.Lines = append(result.Lines, &models.LyricLine{Text: line})
+	}
+	if n := len(result.Lines); n > 0 && result.Lines[n-1].Text == "" {
+		result.Lines = result.Lines[:n-1]
+	}
+	return result
+}
+
 var matcher = NewStringMatcher([]string{"(", "（", "[", "［", "【", "〖", "＜", "〈", "《", "-", "―", "—", " feat.", " ft.", " ver."})
 
 func StripTitle(title string) string {
@@ -127,3 +363,71 @@ func StripTitle(title string) string {
 	}
 	return strings.TrimSpace(string(b[:idx]))
 }
+
+var artistSplitter = strings.NewReplacer("&", "\x00", ",", "\x00", "，", "\x00", "、", "\x00", "/", "\x00", ";", "\x00", " feat. ", "\x00", " ft. ", "\x00", " x ", "\x00", " and ", "\x00")
+
+// Normalize folds case, full-width forms and punctuation so that cosmetic differences don't matter
+func Normalize(s string) string {
+	builder := &strings.Builder{}
+	space := true
+	for _, r := range s {
+		switch {
+		case r >= 0xff01 && r <= 0xff5e: // Full-width ASCII variants
+			r -= 0xfee0
+		case r == 0x3000: // Ideographic space
+			r = ' '
+		}
+		if unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r) {
+			if !space {
+				builder.WriteByte(' ')
+				space = true
+			}
+			continue
+		}
+		builder.WriteRune(unicode.ToLower(r))
+		space = false
+	}
+	return strings.TrimRight(builder.String(), " ")
+}
+
+// SplitArtists splits joined artist names like "A & B" or "A feat. B"
+func SplitArtists(artists []string) []string {
+	result := []string{}
+	for _, artist := range artists {
+		for a := range strings.SplitSeq(artistSplitter.Replace(strings.ToLower(artist)), "\x00") {
+			if a = Normalize(a); a != "" && !slices.Contains(result, a) {
+				result = append(result, a)
+			}
+		}
+	}
+	return result
+}
+
+// Similarity returns 1 minus the normalized Levenshtein distance of a and b
+func Similarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	ra := []rune(a)
+	rb := []rune(b)
+	if len(ra) == 0 || len(rb) == 0 {
+		return 0
+	}
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return 1 - float64(prev[len(rb)])/float64(max(len(ra), len(rb)))
+}
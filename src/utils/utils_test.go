@@ -0,0 +1,236 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"lrcd/models"
+)
+
+func TestParseLrc(t *testing.T) {
+	text := "[ti:test]\n[00:01.00][00:10.00]plain line\n[00:05.00]<00:05.00>Hello <00:05.50>world<00:06.00>\n"
+	lrc, err := ParseLrc(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := lrc.Lines
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %d", len(lines))
+	}
+	if lines[0].Position != 1000 || lines[0].Text != "plain line" || lines[0].Words != nil {
+		t.Errorf("unexpected line %+v", lines[0])
+	}
+	line := lines[1]
+	if line.Position != 5000 || line.Text != "Hello world" {
+		t.Errorf("unexpected line %+v", line)
+	}
+	if len(line.Words) != 2 {
+		t.Fatalf("expected 2 words, got %d", len(line.Words))
+	}
+	if line.Words[0].Position != 5000 || line.Words[0].Text != "Hello " {
+		t.Errorf("unexpected word %+v", line.Words[0])
+	}
+	if line.Words[1].Position != 5500 || line.Words[1].Text != "world" {
+		t.Errorf("unexpected word %+v", line.Words[1])
+	}
+}
+
+func TestParseLrcTags(t *testing.T) {
+	text := "[ti: Title ]\n[ar:A]\n[ar:B]\n[al:Album]\n[length:03:05]\n[offset:+500]\n[by:someone]\n[00:01.00]<00:01.00>line <00:01.50>two\n"
+	lrc, err := ParseLrc(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lrc.Title != "Title" || len(lrc.Artists) != 2 || lrc.Album != "Album" || lrc.Length != 185*time.Second || lrc.Offset != 500 {
+		t.Errorf("unexpected tags %+v", lrc)
+	}
+	if by := lrc.Tags["by"]; len(by) != 1 || by[0] != "someone" {
+		t.Errorf("unexpected raw tags %v", lrc.Tags)
+	}
+	line := lrc.Lines[0]
+	if line.Position != 500 || line.Words[1].Position != 1000 {
+		t.Errorf("offset not applied: %+v", line)
+	}
+	candidate := lrc.Candidate(&models.MPRISMetadata{Title: "Other", Artists: []string{"C"}, Duration: time.Minute})
+	if candidate.Titles[0] != "Title" || len(candidate.Artists) != 2 || candidate.Duration != 185*time.Second {
+		t.Errorf("unexpected candidate %+v", candidate)
+	}
+}
+
+func TestParseLrcTranslation(t *testing.T) {
+	lrc, err := ParseLrc("[00:01.00]\n[00:01.00]original\n[00:01.00]translation\n[00:01.00]romanization\n[00:02.00]next\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lrc.Lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(lrc.Lines))
+	}
+	line := lrc.Lines[0]
+	if line.Text != "original" || line.Translation != "translation" || line.Romanization != "romanization" {
+		t.Errorf("unexpected line %+v", line)
+	}
+	if got := (&models.Lyrics{Lines: lrc.Lines}).EnhancedLRC(nil); got != "[00:01.000]original\n[00:01.000]translation\n[00:01.000]romanization\n[00:02.000]next\n" {
+		t.Errorf("unexpected lrc:\n%s", got)
+	}
+
+	secondary := []*models.LyricLine{{Position: 1050, Text: "close"}, {Position: 2500, Text: "far"}}
+	texts := AlignLines(lrc.Lines, secondary)
+	if texts[0] != "close" || texts[1] != "" {
+		t.Errorf("unexpected alignment %q", texts)
+	}
+}
+
+func TestLineEnds(t *testing.T) {
+	lrc, err := ParseLrc("[offset:500]\n[00:01.00]<00:01.00>Hello <00:01.50>world<00:02.50>\n[00:03.00]guitar solo\n[00:30.00]\n[00:31.00]春日影\n[00:40.00]end\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lyrics := &models.Lyrics{Lines: lrc.Lines}
+	if lrc.Lines[0].End != 2000 || lyrics.EndOf(0) != 2000 {
+		t.Errorf("trailing word stamp not read as end: %+v", lrc.Lines[0])
+	}
+	if end := lyrics.EndOf(1); end != 2500+2*500+1000 {
+		t.Errorf("unexpected estimated end %d", end)
+	}
+	if end := lyrics.EndOf(2); end != 29500 {
+		t.Errorf("empty line should end immediately, got %d", end)
+	}
+	if end := lyrics.EndOf(3); end != 30500+3*500+1000 {
+		t.Errorf("unexpected estimated end %d", end)
+	}
+	if !strings.HasPrefix(lyrics.EnhancedLRC(nil), "[00:00.500]<00:00.500>Hello <00:01.000>world<00:02.000>\n") {
+		t.Errorf("end not written:\n%s", lyrics.EnhancedLRC(nil))
+	}
+}
+
+func TestParseLrcRepeatedWords(t *testing.T) {
+	lrc, err := ParseLrc("[00:01.00][00:11.00]la <00:01.50>la")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := lrc.Lines
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(lines))
+	}
+	if lines[1].Words[1].Position != 11500 {
+		t.Errorf("expected shifted word at 11500, got %d", lines[1].Words[1].Position)
+	}
+}
+
+func TestFormatFilename(t *testing.T) {
+	meta := &models.MPRISMetadata{
+		Title:    "春日影",
+		Artists:  []string{"CRYCHIC"},
+		Album:    "春日影",
+		Duration: 246400 * time.Millisecond,
+	}
+	if name := FormatFilename(meta); name != "春日影 - CRYCHIC [春日影] (245s).cache" {
+		t.Errorf("unexpected filename %q", name)
+	}
+	live := meta.Clone()
+	live.Duration = 262 * time.Second
+	if FormatFilename(&live) == FormatFilename(meta) {
+		t.Error("different durations share a filename")
+	}
+	long := meta.Clone()
+	long.Title = strings.Repeat("長", 100)
+	if name := FormatFilename(&long); len(name) != 38 {
+		t.Errorf("long title not hashed: %q", name)
+	}
+	slash := meta.Clone()
+	slash.Artists = []string{"AC/DC"}
+	if name := FormatFilename(&slash); strings.Contains(name, "/") {
+		t.Errorf("unsafe filename %q", name)
+	}
+}
+
+func TestParseLyricsSubtitles(t *testing.T) {
+	srt := "1\r\n00:00:01,000 --> 00:00:03,500\r\n<i>first</i> line\r\n\r\n2\r\n00:00:04,000 --> 00:00:06,000\r\nsecond\r\nline\r\n"
+	vtt := "WEBVTT\n\nNOTE comment\n\nintro\n00:01.000 --> 00:03.500 align:start\nfirst line\n\n00:04.000 --> 00:06.000\n<00:04.000>second <c.x><00:05.000>line</c>\n"
+	ttml := `<?xml version="1.0" encoding="UTF-8"?>
+<tt xmlns="http://www.w3.org/ns/ttml" xmlns:itunes="http://music.apple.com/lyric-ttml-internal">
+  <head><metadata><iTunesMetadata><translations><translation xml:lang="en">
+    <text for="L2">translated</text>
+  </translation></translations></iTunesMetadata></metadata></head>
+  <body><div>
+    <p begin="1.0s" end="3.5s" itunes:key="L1">first line</p>
+    <p begin="00:04.000" end="00:06.000" itunes:key="L2">
+      <span begin="00:04.000" end="00:05.000">second</span> <span begin="00:05.000" end="00:06.000">line</span>
+    </p>
+  </div></body>
+</tt>`
+	for name, text := range map[string]string{"srt": srt, "vtt": vtt, "ttml": ttml} {
+		lrc, err := ParseLyrics(text)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		lines := lrc.Lines
+		if len(lines) != 2 {
+			t.Errorf("%s: expected 2 lines, got %d", name, len(lines))
+			continue
+		}
+		if lines[0].Position != 1000 || lines[0].End != 3500 || lines[0].Text != "first line" {
+			t.Errorf("%s: unexpected line %+v", name, lines[0])
+		}
+		if lines[1].Position != 4000 || lines[1].End != 6000 || lines[1].Text != "second line" {
+			t.Errorf("%s: unexpected line %+v", name, lines[1])
+		}
+		if name == "srt" {
+			continue
+		}
+		if words := lines[1].Words; len(words) != 2 || words[0].Text != "second " || words[1].Position != 5000 || words[1].Text != "line" {
+			t.Errorf("%s: unexpected words %+v", name, words)
+		}
+	}
+	if lrc, err := ParseLyrics(ttml); err == nil && lrc.Lines[1].Translation != "translated" {
+		t.Errorf("unexpected translation %q", lrc.Lines[1].Translation)
+	}
+	if lrc, err := ParseLyrics("[00:01.00]plain"); err != nil || lrc.Lines[0].Text != "plain" {
+		t.Errorf("lrc not detected: %v", err)
+	}
+}
+
+func TestParseTTMLUntimedText(t *testing.T) {
+	ttml := `<tt xmlns="http://www.w3.org/ns/ttml"><body><div>
+  <p begin="1s"><span begin="1s">Hel</span>lo, <span begin="2s">world</span></p>
+</div></body></tt>`
+	lrc, err := ParseLyrics(ttml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	words := lrc.Lines[0].Words
+	if len(words) != 2 || words[0].Position != 1000 || words[0].Text != "Hello, " || words[1].Position != 2000 || words[1].Text != "world" {
+		t.Errorf("untimed text not joined to the previous word: %+v", words)
+	}
+}
+
+func TestParsePlain(t *testing.T) {
+	text := "[ti:Title]\n\nfirst line\nsecond line\n\n\n春日影\n\n"
+	if _, err := ParseLrc(text); !errors.Is(err, ErrNotSynced) {
+		t.Fatalf("expected ErrNotSynced, got %v", err)
+	}
+	lrc := ParsePlain(text)
+	if lrc.Title != "Title" || len(lrc.Lines) != 4 || lrc.Lines[2].Text != "" || lrc.Lines[3].Text != "春日影" {
+		t.Fatalf("unexpected plain lyrics %+v", lrc.Lines)
+	}
+	lyrics := &models.Lyrics{Lines: lrc.Lines, Unsynced: true}
+	estimated := lyrics.EstimateTiming(100 * time.Second)
+	if !estimated.Unsynced || estimated.Lines[0].Position != 10000 || lyrics.Lines[0].Position != 0 {
+		t.Errorf("unexpected estimate %+v", estimated.Lines[0])
+	}
+	for i := 1; i < len(estimated.Lines); i++ {
+		if estimated.Lines[i].Position <= estimated.Lines[i-1].Position || estimated.Lines[i].Position >= 90000 {
+			t.Errorf("unexpected position %d of line %d", estimated.Lines[i].Position, i)
+		}
+	}
+	block := lyrics.Block(100 * time.Second)
+	if block.Len() != 1 || block.Lines[0].Text != "first line\nsecond line\n\n春日影" || block.EndOf(0) != 100000 {
+		t.Errorf("unexpected block %+v", block.Lines[0])
+	}
+	if got := lyrics.LRC(nil); got != "first line\nsecond line\n\n春日影\n" {
+		t.Errorf("unexpected lrc:\n%s", got)
+	}
+}